@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math"
-	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/faiface/beep"
@@ -17,40 +21,116 @@ import (
 	"lukechampine.com/barbershop/shazam"
 )
 
+var (
+	errUnsupportedFormat = errors.New("unsupported audio format")
+	errTruncated         = errors.New("audio file is truncated")
+)
+
+// A decodeError is an error encountered while decoding an audio file.
+type decodeError struct {
+	path   string
+	offset time.Duration // position within the file
+	err    error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("decoding %v at %v: %v", filepath.Base(e.path), renderTime(e.offset), e.err)
+}
+
+func (e *decodeError) Unwrap() error {
+	return e.err
+}
+
+// A checkedStreamer converts the errors of the underlying streamer into
+// decodeErrors, and reports streams that end early as truncated.
+type checkedStreamer struct {
+	beep.StreamSeekCloser
+	path   string
+	format beep.Format
+	// slack is how far short of its reported length the stream may end
+	// without being considered truncated, since some decoders only estimate
+	// their length
+	slack int
+	err   error
+}
+
+func (s *checkedStreamer) Stream(samples [][2]float64) (n int, ok bool) {
+	if s.err != nil {
+		return 0, false
+	}
+	n, ok = s.StreamSeekCloser.Stream(samples)
+	if err := s.StreamSeekCloser.Err(); err != nil {
+		s.err = &decodeError{s.path, s.format.SampleRate.D(s.Position()), err}
+	} else if n < len(samples) && s.Len()-s.Position() > s.slack {
+		s.err = &decodeError{s.path, s.format.SampleRate.D(s.Position()), errTruncated}
+	}
+	return n, ok
+}
+
+func (s *checkedStreamer) Err() error {
+	return s.err
+}
+
+// openStreamer opens the audio file at path, identifying its format by its
+// contents. Decoding errors, including those encountered while streaming, are
+// reported as decodeErrors; unrecognized formats as errUnsupportedFormat.
 func openStreamer(path string) (beep.StreamSeekCloser, beep.Format, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
-	}
-	mimeBuf := make([]byte, 512)
-	if _, err := f.ReadAt(mimeBuf, 0); err != nil {
-		log.Fatalln("Could not detect audio format:", err)
-	}
-	mime := http.DetectContentType(mimeBuf)
-	switch mime {
-	case "audio/wave":
-		return wav.Decode(f)
-	case "audio/mpeg":
-		return mp3.Decode(f)
-	case "application/ogg":
-		return vorbis.Decode(f)
+		return nil, beep.Format{}, err
+	}
+	hdr := make([]byte, 512)
+	if n, err := f.ReadAt(hdr, 0); err != nil && err != io.EOF {
+		f.Close()
+		return nil, beep.Format{}, &decodeError{path, 0, err}
+	} else if n == 0 {
+		f.Close()
+		return nil, beep.Format{}, &decodeError{path, 0, errTruncated}
+	}
+	var stream beep.StreamSeekCloser
+	var format beep.Format
+	var estimated bool // length is derived from metadata, not the decoded data
+	switch sniffFormat(hdr) {
+	case formatWAV:
+		stream, format, err = wav.Decode(f)
+	case formatMP3:
+		stream, format, err = mp3.Decode(f)
+	case formatVorbis:
+		stream, format, err = vorbis.Decode(f)
+	case formatOpus, formatFLAC, formatMP4, formatAAC, formatWebM:
+		f.Close()
+		stream, format, err = decodeFFmpeg(path)
+		estimated = true
 	default:
-		return nil, beep.Format{}, fmt.Errorf("unsupported mime type: %s", mime)
+		f.Close()
+		return nil, beep.Format{}, fmt.Errorf("%v: %w", filepath.Base(path), errUnsupportedFormat)
 	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, beep.Format{}, &decodeError{path, 0, errTruncated}
+	} else if err != nil {
+		return nil, beep.Format{}, &decodeError{path, 0, err}
+	}
+	slack := format.SampleRate.N(time.Second)
+	if estimated {
+		// durations reported by ffprobe can be off by a few percent, e.g.
+		// when estimated from the bitrate, but a truncated file usually ends
+		// well short of the duration in its header
+		slack = max(slack, stream.Len()/20)
+	}
+	return &checkedStreamer{stream, path, format, slack, nil}, format, nil
 }
 
 type audioBuffer struct {
-	format          beep.Format
-	samples         [][2]float64
-	start, pos, end int
+	audio *decodedAudio
+	pos   int
 
 	r *beep.Resampler
 	v *effects.Volume
 }
 
 func (ab *audioBuffer) seek(delta time.Duration) {
-	ab.pos += ab.format.SampleRate.N(delta)
-	ab.pos = max(ab.start, min(ab.pos, ab.end))
+	ab.pos += ab.audio.format.SampleRate.N(delta)
+	ab.pos = max(0, min(ab.pos, ab.audio.Len()))
 }
 
 func (ab *audioBuffer) setRatio(r float64) {
@@ -62,7 +142,7 @@ func (ab *audioBuffer) setVolume(v float64) {
 }
 
 func (ab *audioBuffer) times() (pos, total time.Duration) {
-	return ab.format.SampleRate.D(ab.pos), ab.format.SampleRate.D(len(ab.samples))
+	return ab.audio.format.SampleRate.D(ab.pos), ab.audio.format.SampleRate.D(ab.audio.Len())
 }
 
 func (ab *audioBuffer) Stream(samples [][2]float64) (n int, ok bool) {
@@ -73,22 +153,15 @@ func (ab *audioBuffer) Err() error {
 	return ab.v.Err()
 }
 
-func newAudioBuffer(format beep.Format, stream beep.Streamer) *audioBuffer {
-	ab := &audioBuffer{format: format}
-	for {
-		var samples [512][2]float64
-		n, ok := stream.Stream(samples[:])
-		ab.samples = append(ab.samples, samples[:n]...)
-		if !ok {
-			break
-		}
-	}
-	ab.end = len(ab.samples)
+// newAudioBuffer returns a buffer that plays audio on a loop. Since audio is
+// already decoded, streaming it never blocks the speaker.
+func newAudioBuffer(audio *decodedAudio) *audioBuffer {
+	ab := &audioBuffer{audio: audio}
 	abStream := func(samples [][2]float64) (n int, ok bool) {
-		if ab.pos >= ab.end {
-			ab.pos = ab.start
+		if ab.pos >= audio.Len() {
+			ab.pos = 0
 		}
-		n = copy(samples, ab.samples[ab.pos:ab.end])
+		n = audio.read(samples, ab.pos, audio.Len())
 		ab.pos += n
 		return n, true
 	}
@@ -103,8 +176,7 @@ func newAudioBuffer(format beep.Format, stream beep.Streamer) *audioBuffer {
 
 // global playback
 var bb = struct {
-	buf    *audioBuffer
-	silent bool
+	buf *audioBuffer
 }{}
 
 func boomboxState() (pos, duration time.Duration, ratio float64) {
@@ -118,15 +190,43 @@ func boomboxState() (pos, duration time.Duration, ratio float64) {
 	return
 }
 
-func boomboxFadeIn(path string) error {
-	if bb.silent {
-		return nil
+// playbackPath returns the file to play for the track at path: the original
+// download that path was derived from, if it was kept, or path itself.
+func playbackPath(path string) string {
+	dir, file := filepath.Split(path)
+	prefix := strings.TrimSuffix(file, filepath.Ext(file)) + ".original."
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), prefix) {
+			return filepath.Join(dir, f.Name())
+		}
 	}
-	stream, format, err := openStreamer(path)
+	return path
+}
+
+// loadPlayback decodes the audio to play for the track at path. The kept
+// original of a download is decoded at its native sample rate; otherwise, the
+// audio decoded for identification is shared.
+func loadPlayback(path string) (*decodedAudio, error) {
+	original := playbackPath(path)
+	if original == path {
+		return loadAudio(path)
+	}
+	stream, format, err := openStreamer(original)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return decodeStream(format, stream)
+}
+
+func boomboxFadeIn(path string) error {
+	audio, err := loadPlayback(path)
 	if err != nil {
 		return err
 	}
-	newBuf := newAudioBuffer(format, stream)
+	format := audio.format
+	newBuf := newAudioBuffer(audio)
 	newBuf.setVolume(-5)
 
 	speaker.Lock()
@@ -135,7 +235,8 @@ func boomboxFadeIn(path string) error {
 	speaker.Unlock()
 	if oldBuf == nil {
 		// crossfade with silence
-		oldBuf = newAudioBuffer(format, beep.Silence(format.SampleRate.N(3*time.Second)))
+		silence, _ := decodeStream(format, beep.Silence(format.SampleRate.N(3*time.Second)))
+		oldBuf = newAudioBuffer(silence)
 		if err := speaker.Init(format.SampleRate, format.SampleRate.N(100*time.Millisecond)); err != nil {
 			return err
 		}
@@ -155,26 +256,30 @@ func boomboxFadeIn(path string) error {
 }
 
 func boomboxFadeOut() {
-	if bb.silent {
-		return
+	speaker.Lock()
+	buf := bb.buf
+	speaker.Unlock()
+	if buf == nil {
+		return // nothing has played, e.g. because every track failed
 	}
 	for i := 0.0; i <= 50; i++ {
 		speaker.Lock()
-		bb.buf.setVolume(0 - (i * 0.1))
+		buf.setVolume(0 - (i * 0.1))
 		speaker.Unlock()
 		time.Sleep(50 * time.Millisecond)
 	}
 	speaker.Lock()
-	bb.buf.v.Silent = true
+	buf.v.Silent = true
 	speaker.Unlock()
 	speaker.Clear()
 }
 
 func boomboxChangeSpeed(speedup float64) {
-	if bb.silent {
+	speaker.Lock()
+	if bb.buf == nil {
+		speaker.Unlock()
 		return
 	}
-	speaker.Lock()
 	for math.Abs(speedup-bb.buf.r.Ratio()) > 0.01 {
 		r := bb.buf.r.Ratio() + (speedup-bb.buf.r.Ratio())/10
 		bb.buf.setRatio(r)
@@ -187,9 +292,6 @@ func boomboxChangeSpeed(speedup float64) {
 }
 
 func boomboxSetSpeed(speedup float64) {
-	if bb.silent {
-		return
-	}
 	speaker.Lock()
 	if bb.buf != nil {
 		bb.buf.setRatio(speedup)
@@ -198,9 +300,6 @@ func boomboxSetSpeed(speedup float64) {
 }
 
 func boomboxSeek(delta time.Duration) {
-	if bb.silent {
-		return
-	}
 	speaker.Lock()
 	if bb.buf != nil {
 		bb.buf.seek(delta)
@@ -209,78 +308,584 @@ func boomboxSeek(delta time.Duration) {
 }
 
 type identifyParams struct {
-	ratio  float64
-	offset time.Duration
+	ratio  float64       // resampling speedup, affecting both tempo and pitch
+	tempo  float64       // pitch-preserving speedup
+	pitch  float64       // tempo-preserving pitch shift, in semitones
+	effect clipEffect    // effect undone before fingerprinting, e.g. reversal
+	filter filterChain   // preprocessing applied before fingerprinting
+	offset time.Duration // position within the track, after resampling by ratio
+}
+
+// newIdentifyParams returns params for a clip at the start of the track with
+// the given transform. Params should always be constructed with it, since the
+// zero values of ratio and tempo would be a speed of 0.
+func newIdentifyParams(ratio, tempo, pitch float64) identifyParams {
+	return identifyParams{ratio: ratio, tempo: tempo, pitch: pitch}
+}
+
+// speed returns the overall playback speed of p.
+func (p identifyParams) speed() float64 {
+	return p.ratio * p.tempo
+}
+
+// trackOffset returns the position within the original track at which the
+// clip described by p starts.
+func (p identifyParams) trackOffset() time.Duration {
+	return time.Duration(float64(p.offset) * p.ratio)
+}
+
+// at returns p with its offset set so that the clip starts at pos within the
+// original track.
+func (p identifyParams) at(pos time.Duration) identifyParams {
+	p.offset = time.Duration(float64(pos) / p.ratio)
+	return p
+}
+
+// span returns the portion of the original track covered by a clip of the
+// given duration.
+func (p identifyParams) span(clip time.Duration) timeRange {
+	start := p.trackOffset()
+	return timeRange{start, start + time.Duration(float64(clip)*p.speed())}
+}
+
+// sameTransform reports whether p and q differ only in their offset.
+func (p identifyParams) sameTransform(q identifyParams) bool {
+	p.offset = q.offset
+	return p == q
 }
 
 type identifyResult struct {
-	params identifyParams
+	params identifyParams // including the effect, if any, that produced res
 	res    shazam.Result
 	skew   float64
+	source timeRange // portion of the matched song covered by the clip
+}
+
+// loadSample decodes duration seconds of 16 kHz mono audio from the file at
+// path, after speeding it up by ratio, starting at offset within the sped-up
+// audio. A negative duration decodes the remainder of the file. The file is
+// decoded into memory, so that later samples from it are cheap.
+func loadSample(path string, ratio float64, offset, duration time.Duration) ([]float64, error) {
+	audio, err := loadAudio(path)
+	if err != nil {
+		return nil, err
+	}
+	return readSample(audio.cursor(), audio.format, ratio, offset, duration)
 }
 
-func identifyPath(path string, params identifyParams) (identifyResult, error) {
+// streamSample is like loadSample, but decodes only the requested audio, and
+// doesn't keep it in memory. It is suited to one-off reads.
+func streamSample(path string, ratio float64, offset, duration time.Duration) ([]float64, error) {
 	stream, format, err := openStreamer(path)
 	if err != nil {
-		return identifyResult{}, err
+		return nil, err
 	}
-	s := beep.ResampleRatio(6, params.ratio*float64(format.SampleRate)/16000, stream)
+	defer stream.Close()
+	sample, err := readSample(stream, format, ratio, offset, duration)
+	if err == nil {
+		err = stream.Err()
+	}
+	return sample, err
+}
+
+// readSample reads a sample from stream, as described by loadSample.
+func readSample(stream beep.StreamSeeker, format beep.Format, ratio float64, offset, duration time.Duration) ([]float64, error) {
+	start := format.SampleRate.N(time.Duration(float64(offset) * ratio))
+	if start >= stream.Len() {
+		return nil, nil
+	} else if err := stream.Seek(start); err != nil {
+		return nil, err
+	}
+	if duration < 0 {
+		duration = time.Duration(float64(format.SampleRate.D(stream.Len()-start)) / ratio)
+	}
+	s := beep.ResampleRatio(6, ratio*float64(format.SampleRate)/16000, stream)
 	format.SampleRate = 16000
-	sample := shazam.CollectSample(s, format, params.offset, 12*time.Second)
-	res, err := shazam.Identify(shazam.ComputeSignature(int(format.SampleRate), sample))
+	return shazam.CollectSample(s, format, 0, duration), nil
+}
+
+// computeSignature computes the signature of the clip described by params.
+func computeSignature(path string, params identifyParams, duration time.Duration) (shazam.Signature, error) {
+	// collect enough audio to fill duration after stretching
+	sample, err := loadSample(path, params.ratio, params.offset, time.Duration(float64(duration)*params.tempo))
 	if err != nil {
-		return identifyResult{}, err
+		return shazam.Signature{}, err
+	}
+	sample = timeStretch(sample, params.tempo)
+	sample = pitchShift(sample, params.pitch)
+	sample = params.effect.apply(sample, 16000)
+	sample = params.filter.apply(sample, 16000)
+	return shazam.ComputeSignature(16000, sample), nil
+}
+
+// identifyPath identifies the clip of the track at path described by params.
+// If cache is non-nil, results are looked up in and stored to it.
+func identifyPath(ctx context.Context, backend identifier, cache *resultCache, path string, params identifyParams) (identifyResult, error) {
+	res, ok := cache.get(path, params, clipDuration)
+	if !ok {
+		sig, err := computeSignature(path, params, clipDuration)
+		if err != nil {
+			return identifyResult{}, err
+		}
+		res, err = backend.Identify(ctx, sig)
+		if err != nil {
+			return identifyResult{}, err
+		}
+		cache.put(path, params, clipDuration, res) // caching is best-effort
+	}
+	var source timeRange
+	if res.Found {
+		// the clip plays (1+skew) times faster than the matched song
+		source = timeRange{res.Offset, res.Offset + time.Duration(float64(clipDuration)*(1+res.Skew))}
 	}
 	return identifyResult{
 		params: params,
 		res:    res,
 		skew:   min(10*math.Abs(res.Skew), 1),
+		source: source,
 	}, nil
 }
 
+// searchOptions configures how a trackIdentifier searches for samples.
+type searchOptions struct {
+	backend identifier
+	// adaptive uses the skew of each match to refine the speed of subsequent
+	// queries, rather than sticking to a fixed grid of speeds
+	adaptive bool
+	// timeline scans the entire track for samples, rather than stopping at
+	// the first confident match
+	timeline bool
+	// parallel is the maximum number of queries in flight at once
+	parallel int
+	// cache stores results across runs; if nil, results are not cached
+	cache *resultCache
+	// links fetches streaming links for identified samples
+	links *shazam.Client
+	// offline disables link lookups that bypass the links client, namely
+	// searching YouTube with yt-dlp
+	offline bool
+	// silent disables audio playback
+	silent bool
+	// filter, if non-zero, is the preprocessing with which a clip that fails
+	// to match is retried before moving on to the next transform. It is not
+	// used in timeline mode.
+	filter filterChain
+}
+
+const (
+	// skews smaller than this are considered exact
+	minRefineSkew = 0.002
+	// skews larger than this are assumed to be spurious
+	maxRefineSkew  = 0.15
+	maxRefinements = 3
+
+	// clip duration
+	clipDuration = 12 * time.Second
+	// in timeline mode, the number of untried transforms to attempt for each
+	// window, in addition to those that have already matched
+	timelineProbes = 6
+)
+
+// A timeRange is a span of time within a track.
+type timeRange struct {
+	start, end time.Duration
+}
+
+// A timelineEntry is a sample that appears one or more times within a track.
+type timelineEntry struct {
+	res    shazam.Result
+	params identifyParams // params of the first match
+	ranges []timeRange
+}
+
+// trackInfo describes a fetched track.
+type trackInfo struct {
+	path     string
+	duration time.Duration
+	bpm      float64
+}
+
 type trackIdentifier struct {
+	backend identifier
+	cache   *resultCache
 	path    string
+	bpm     float64
 	params  []identifyParams
 	results []identifyResult
 	sample  *identifyResult
+
+	// queries are issued ahead of time, but their results are handled in
+	// order
+	parallel int
+	inflight map[identifyParams]bool
+	answered map[identifyParams]identifyResult
+	done     bool
+
+	filter      filterChain
+	adaptive    bool
+	refinements int
+	// the most recent refinement, and the transform it replaced; cleared once
+	// the refinement matches
+	coarse, refined *identifyParams
+
+	// timeline mode
+	timelineMode bool
+	timeline     []timelineEntry
+	windows      []time.Duration // remaining window offsets
+	transforms   []identifyParams
+	matched      []identifyParams // transforms that have matched, most recent first
 }
 
-func newTrackIdentifier(path string) *trackIdentifier {
-	var params []identifyParams
+// analyzeTrack determines the duration and tempo of the track at path.
+func analyzeTrack(path string) (trackInfo, error) {
+	stream, format, err := openStreamer(path)
+	if err != nil {
+		return trackInfo{}, err
+	}
+	defer stream.Close()
+	duration := format.SampleRate.D(stream.Len())
+	sample, err := readSample(stream, format, 1, 0, 2*time.Minute)
+	if err == nil {
+		err = stream.Err()
+	}
+	if err != nil {
+		return trackInfo{}, err
+	}
+	return trackInfo{
+		path:     path,
+		duration: duration,
+		bpm:      detectTempo(sample, 16000),
+	}, nil
+}
+
+// tempoPrior returns how unlikely it is that a track with the given tempo was
+// sped up by speed, based on the tempos of common source material. Lower is
+// more likely.
+func tempoPrior(bpm, speed float64) float64 {
+	const minSourceBPM, maxSourceBPM = 90, 130
+	dist := func(bpm float64) float64 {
+		if bpm < minSourceBPM {
+			return math.Log2(minSourceBPM / bpm)
+		} else if bpm > maxSourceBPM {
+			return math.Log2(bpm / maxSourceBPM)
+		}
+		return 0
+	}
+	// the detected tempo may be off by an octave
+	src := bpm / speed
+	return min(dist(src), dist(src*2)+0.25, dist(src/2)+0.25)
+}
+
+func newTrackIdentifier(opts searchOptions, info trackInfo) *trackIdentifier {
+	var resampled, stretched, shifted []identifyParams
 	for _, speedup := range []float64{1.20, 1.30, 1.10, 1.25, 1.15, 1.40, 1.50, 0.90, 0.80, 1.60, 1.70, 1.80, 1.90, 2.00, 1.00} {
-		for _, offset := range []time.Duration{24 * time.Second, 48 * time.Second, 72 * time.Second} {
-			params = append(params, identifyParams{speedup, offset})
+		resampled = append(resampled, newIdentifyParams(speedup, 1, 0))
+	}
+	// if resampling fails, try changing tempo and pitch independently
+	for _, tempo := range []float64{1.20, 1.10, 1.30, 0.90} {
+		stretched = append(stretched, newIdentifyParams(1, tempo, 0))
+	}
+	for _, pitch := range []float64{2, -2, 1, -1} {
+		shifted = append(shifted, newIdentifyParams(1, 1, pitch))
+	}
+	if info.bpm > 0 {
+		// try the most plausible speeds first
+		for _, ps := range [][]identifyParams{resampled, stretched} {
+			sort.SliceStable(ps, func(i, j int) bool {
+				return tempoPrior(info.bpm, ps[i].speed()) < tempoPrior(info.bpm, ps[j].speed())
+			})
 		}
 	}
-	return &trackIdentifier{
-		path:   path,
-		params: params,
+	transforms := append(append(resampled, stretched...), shifted...)
+	// if those fail, try undoing effects that alter the sample as a whole
+	var effected []identifyParams
+	for _, e := range []clipEffect{effectReverse, effectUnfilter, effectHighShelf} {
+		for _, p := range resampled {
+			p.effect = e
+			effected = append(effected, p)
+		}
+	}
+	id := &trackIdentifier{
+		backend:  opts.backend,
+		cache:    opts.cache,
+		path:     info.path,
+		bpm:      info.bpm,
+		parallel: max(opts.parallel, 1),
+		inflight: make(map[identifyParams]bool),
+		answered: make(map[identifyParams]identifyResult),
+		filter:   opts.filter,
+		adaptive: opts.adaptive,
+	}
+	if opts.timeline {
+		id.timelineMode = true
+		for offset := time.Duration(0); offset+clipDuration <= info.duration; offset += clipDuration {
+			id.windows = append(id.windows, offset)
+		}
+		if len(id.windows) == 0 {
+			id.windows = []time.Duration{0}
+		}
+		id.transforms = transforms
+		id.nextWindow()
+		return id
 	}
+	for _, p := range append(transforms, effected...) {
+		for _, offset := range []time.Duration{24 * time.Second, 48 * time.Second, 72 * time.Second} {
+			p.offset = offset
+			id.params = append(id.params, p)
+		}
+	}
+	return id
 }
 
 func (id *trackIdentifier) currentParams() identifyParams {
 	return id.params[0]
 }
 
+// queries returns the params that should be queried next, and marks them as
+// in flight. A miss usually skips the remaining offsets of a transform, so at
+// most one query per transform is in flight at a time.
+func (id *trackIdentifier) queries() []identifyParams {
+	if id.done {
+		return nil
+	}
+	var qs []identifyParams
+	n := len(id.inflight)
+	for _, p := range id.params {
+		if n >= id.parallel {
+			break
+		}
+		busy := false
+		for q := range id.inflight {
+			busy = busy || q.sameTransform(p)
+		}
+		if _, ok := id.answered[p]; ok || busy {
+			continue
+		}
+		id.inflight[p] = true
+		qs = append(qs, p)
+		n++
+	}
+	return qs
+}
+
+// addResult records the result of a query, handling it once all preceding
+// queries have been handled. It reports whether the search is complete.
+func (id *trackIdentifier) addResult(r identifyResult) bool {
+	delete(id.inflight, r.params)
+	id.answered[r.params] = r
+	for !id.done {
+		r, ok := id.answered[id.currentParams()]
+		if !ok {
+			break
+		}
+		id.done = id.handleResult(r) == nil
+	}
+	return id.done
+}
+
+// run performs the search, issuing queries concurrently.
+func (id *trackIdentifier) run(ctx context.Context) error {
+	type response struct {
+		r   identifyResult
+		err error
+	}
+	ch := make(chan response, id.parallel)
+	pending := 0
+	for {
+		for _, p := range id.queries() {
+			pending++
+			go func(p identifyParams) {
+				r, err := identifyPath(ctx, id.backend, id.cache, id.path, p)
+				ch <- response{r, err}
+			}(p)
+		}
+		if pending == 0 {
+			return nil
+		}
+		resp := <-ch
+		pending--
+		if resp.err != nil || id.addResult(resp.r) {
+			// wait for outstanding queries before returning
+			for ; pending > 0; pending-- {
+				<-ch
+			}
+			return resp.err
+		}
+	}
+}
+
+// nextWindow queues params for the next timeline window: first the transforms
+// that have already matched, then the most plausible untried transforms.
+func (id *trackIdentifier) nextWindow() {
+	offset := id.windows[0]
+	id.windows = id.windows[1:]
+	id.params = id.params[:0]
+	add := func(p identifyParams) {
+		for _, q := range id.params {
+			if q.sameTransform(p) {
+				return
+			}
+		}
+		id.params = append(id.params, p.at(offset))
+	}
+	for _, p := range id.matched {
+		add(p)
+	}
+	for i := 0; i < len(id.transforms) && i < timelineProbes; i++ {
+		add(id.transforms[i])
+	}
+	// rotate the untried transforms, so that each window probes new ones
+	if n := min(timelineProbes, len(id.transforms)); n > 0 {
+		id.transforms = append(id.transforms[n:], id.transforms[:n]...)
+	}
+}
+
+// handleTimelineResult is the timeline-mode equivalent of handleResult.
+func (id *trackIdentifier) handleTimelineResult(r identifyResult) (nextParams *identifyParams) {
+	if r.res.Found {
+		id.results = append(id.results, r)
+		p := r.params
+		if refined, ok := refine(r); ok && id.adaptive {
+			p = refined
+		}
+		for i := range id.matched {
+			if id.matched[i].sameTransform(p) {
+				id.matched = append(id.matched[:i], id.matched[i+1:]...)
+				break
+			}
+		}
+		id.matched = append([]identifyParams{p}, id.matched...)
+		id.addToTimeline(r)
+		id.params = id.params[:1] // move on to the next window
+	}
+	if len(id.params) > 1 {
+		id.params = id.params[1:]
+	} else if len(id.windows) > 0 {
+		id.nextWindow()
+	} else {
+		// done; report the most prevalent sample
+		var longest time.Duration
+		for _, e := range id.timeline {
+			var total time.Duration
+			for _, tr := range e.ranges {
+				total += tr.end - tr.start
+			}
+			if total > longest {
+				longest = total
+				for i := range id.results {
+					if id.results[i].res.Artist == e.res.Artist && id.results[i].res.Title == e.res.Title {
+						id.sample = &id.results[i]
+					}
+				}
+			}
+		}
+		return nil
+	}
+	p := id.params[0]
+	return &p
+}
+
+// addToTimeline records a timeline match, merging it with any adjacent
+// matches of the same sample.
+func (id *trackIdentifier) addToTimeline(r identifyResult) {
+	span := r.params.span(clipDuration)
+	for i := range id.timeline {
+		e := &id.timeline[i]
+		if e.res.Artist != r.res.Artist || e.res.Title != r.res.Title {
+			continue
+		}
+		if last := &e.ranges[len(e.ranges)-1]; span.start <= last.end+clipDuration/2 {
+			last.end = max(last.end, span.end)
+		} else {
+			e.ranges = append(e.ranges, span)
+		}
+		return
+	}
+	id.timeline = append(id.timeline, timelineEntry{
+		res:    r.res,
+		params: r.params,
+		ranges: []timeRange{span},
+	})
+}
+
+// retarget replaces the transform of each pending params matching from with
+// the transform of to.
+func (id *trackIdentifier) retarget(from, to identifyParams) {
+	for i := 1; i < len(id.params); i++ {
+		if id.params[i].sameTransform(from) {
+			offset := id.params[i].offset
+			id.params[i] = to
+			id.params[i].offset = offset
+		}
+	}
+}
+
+// refine returns the transform that the skew of r suggests is exact.
+func refine(r identifyResult) (identifyParams, bool) {
+	skew := r.res.Skew
+	if r.params.tempo == 1 && r.params.pitch == 0 && r.res.FrequencySkew != 0 {
+		// resampling affects time and frequency equally, so use both
+		skew = (r.res.Skew + r.res.FrequencySkew) / 2
+	}
+	if math.Abs(skew) < minRefineSkew || math.Abs(skew) > maxRefineSkew || r.params.pitch != 0 {
+		return identifyParams{}, false
+	}
+	p := r.params
+	if p.tempo != 1 {
+		p.tempo = math.Round(1000*p.tempo/(1+skew)) / 1000
+	} else {
+		p.ratio = math.Round(1000*p.ratio/(1+skew)) / 1000
+	}
+	return p, !p.sameTransform(r.params)
+}
+
 func (id *trackIdentifier) handleResult(r identifyResult) (nextParams *identifyParams) {
+	if id.timelineMode {
+		return id.handleTimelineResult(r)
+	}
 	if !r.res.Found {
-		// skip to the next speedup without trying other offsets
-		for len(id.params) > 2 && id.params[1].ratio == r.params.ratio {
-			id.params = id.params[1:]
+		if id.refined != nil && r.params.sameTransform(*id.refined) {
+			// the refinement didn't pan out; go back to the original transform
+			id.retarget(*id.refined, *id.coarse)
+			id.coarse, id.refined = nil, nil
+		} else if id.filter != 0 && r.params.filter == 0 {
+			// retry the same clip with preprocessing, and use it for the
+			// remaining offsets
+			p := r.params
+			p.filter = id.filter
+			id.retarget(r.params, p)
+			id.params = append([]identifyParams{id.params[0], p}, id.params[1:]...)
+		} else {
+			// skip to the next speedup without trying other offsets
+			for len(id.params) > 2 && id.params[1].sameTransform(r.params) {
+				id.params = id.params[1:]
+			}
 		}
 	} else {
 		// have we found a match?
 		id.results = append(id.results, r)
-		hits := 0
+		offsets := make(map[time.Duration]bool)
 		for _, res := range id.results {
 			if res.res.Artist == r.res.Artist && res.res.Title == r.res.Title {
-				hits++
+				offsets[res.params.offset] = true
 			}
 		}
-		if hits == 3 {
+		if len(offsets) == 3 {
 			id.sample = &r
 			return nil
 		}
+		if id.refined != nil && r.params.sameTransform(*id.refined) {
+			id.coarse, id.refined = nil, nil
+		}
+		// re-query the same clip at the refined speed, and use it for the
+		// remaining offsets
+		if p, ok := refine(r); ok && id.adaptive && id.refinements < maxRefinements {
+			id.refinements++
+			coarse := r.params
+			id.coarse, id.refined = &coarse, &p
+			id.retarget(r.params, p)
+			id.params = append([]identifyParams{id.params[0], p}, id.params[1:]...)
+		}
 	}
 
 	// have we exhausted all params?
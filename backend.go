@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+	"lukechampine.com/barbershop/shazam"
+)
+
+// An identifier attempts to identify a song from its audio signature.
+type identifier interface {
+	Identify(ctx context.Context, sig shazam.Signature) (shazam.Result, error)
+}
+
+// identifierFunc is an adapter that allows the use of ordinary functions as
+// identifiers.
+type identifierFunc func(context.Context, shazam.Signature) (shazam.Result, error)
+
+func (fn identifierFunc) Identify(ctx context.Context, sig shazam.Signature) (shazam.Result, error) {
+	return fn(ctx, sig)
+}
+
+type identifierConfig struct {
+	backend   string
+	indexPath string
+	// limiter throttles requests to remote backends; if nil, the backend's
+	// default limit applies
+	limiter *rate.Limiter
+	// httpClient is used for requests to remote backends; if nil, the
+	// backend's default client is used
+	httpClient *http.Client
+}
+
+// cassetteClient returns an HTTP client that records API responses to the
+// record directory, or replays them from the replay directory.
+func cassetteClient(record, replay string) (*http.Client, error) {
+	switch {
+	case record != "" && replay != "":
+		return nil, errors.New("cannot record and replay at the same time")
+	case record != "":
+		rec, err := shazam.NewRecorder(record, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Client{Transport: rec, Timeout: 30 * time.Second}, nil
+	case replay != "":
+		rep, err := shazam.NewReplayer(replay)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Client{Transport: rep}, nil
+	}
+	return nil, nil
+}
+
+// cacheBackendKey identifies the backend described by cfg in result cache
+// keys. Local results are additionally keyed by the index version, since they
+// change whenever tracks are indexed.
+func cacheBackendKey(cfg identifierConfig) string {
+	if cfg.backend == "local" {
+		if stat, err := os.Stat(cfg.indexPath); err == nil {
+			return fmt.Sprintf("local:%v:%v", cfg.indexPath, stat.ModTime().UnixNano())
+		}
+	}
+	return cfg.backend
+}
+
+func defaultIndexPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "barbershop", "index.gob")
+}
+
+var backends = map[string]func(cfg identifierConfig) (identifier, error){
+	"shazam": func(cfg identifierConfig) (identifier, error) {
+		var opts []shazam.ClientOption
+		if cfg.limiter != nil {
+			opts = append(opts, shazam.WithRateLimiter(cfg.limiter))
+		}
+		if cfg.httpClient != nil {
+			opts = append(opts, shazam.WithHTTPClient(cfg.httpClient))
+		}
+		return shazam.NewClient(opts...), nil
+	},
+	"local": func(cfg identifierConfig) (identifier, error) {
+		idx, err := shazam.LoadIndex(cfg.indexPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("no local index found at %v", cfg.indexPath)
+		} else if err != nil {
+			return nil, err
+		}
+		return idx, nil
+	},
+}
+
+// keyLabel returns the name of the Key field of results from backend: a Shazam
+// track key, or the content hash of a locally indexed file.
+func keyLabel(backend identifier) string {
+	if _, ok := backend.(*shazam.Index); ok {
+		return "Index ID"
+	}
+	return "Shazam key"
+}
+
+func backendNames() string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func newIdentifier(cfg identifierConfig) (identifier, error) {
+	newFn, ok := backends[cfg.backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q (available: %v)", cfg.backend, backendNames())
+	}
+	return newFn(cfg)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lukechampine.com/barbershop/shazam"
+)
+
+// A resultCache stores identification results on disk, keyed by the content of
+// the audio file, the clip parameters, and the backend, so that re-running a
+// track doesn't re-send the same clips. Each result is stored in its own file.
+type resultCache struct {
+	dir        string
+	backend    string
+	ttl        time.Duration
+	maxEntries int
+
+	mu     sync.Mutex
+	hashes map[string]cachedHash // path -> content hash
+}
+
+type cachedHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+type cachedResult struct {
+	Created time.Time     `json:"created"`
+	Result  shazam.Result `json:"result"`
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "barbershop", "results")
+}
+
+// fileHash returns the content hash of the file at path, rehashing it only if
+// it has changed since the last call.
+func (c *resultCache) fileHash(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	h, ok := c.hashes[path]
+	c.mu.Unlock()
+	if ok && h.size == stat.Size() && h.modTime.Equal(stat.ModTime()) {
+		return h.hash, nil
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.hashes[path] = cachedHash{stat.Size(), stat.ModTime(), hash}
+	c.mu.Unlock()
+	return hash, nil
+}
+
+func (c *resultCache) entryPath(path string, params identifyParams, d time.Duration) (string, error) {
+	hash, err := c.fileHash(path)
+	if err != nil {
+		return "", err
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("%v|%v|%v|%v|%v|%v|%v|%v|%v", hash, c.backend, params.ratio, params.tempo, params.pitch, params.effect, params.filter, params.offset, d)))
+	name := hex.EncodeToString(key[:16])
+	return filepath.Join(c.dir, name[:2], name+".json"), nil
+}
+
+// get returns the cached result for the clip of path described by params and
+// d, if one exists and has not expired.
+func (c *resultCache) get(path string, params identifyParams, d time.Duration) (shazam.Result, bool) {
+	if c == nil {
+		return shazam.Result{}, false
+	}
+	p, err := c.entryPath(path, params, d)
+	if err != nil {
+		return shazam.Result{}, false
+	}
+	js, err := os.ReadFile(p)
+	if err != nil {
+		return shazam.Result{}, false
+	}
+	var cr cachedResult
+	if err := json.Unmarshal(js, &cr); err != nil || (c.ttl > 0 && time.Since(cr.Created) > c.ttl) {
+		return shazam.Result{}, false
+	}
+	return cr.Result, true
+}
+
+// put stores the result for the clip of path described by params and d.
+func (c *resultCache) put(path string, params identifyParams, d time.Duration, res shazam.Result) error {
+	if c == nil {
+		return nil
+	}
+	p, err := c.entryPath(path, params, d)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(cachedResult{time.Now(), res})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, js)
+}
+
+// writeFileAtomic writes data to path via a uniquely named temporary file, so
+// that concurrent writers never observe or clobber a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	} else if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	} else if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// entries returns every entry in the cache, oldest first.
+func (c *resultCache) entries() ([]cacheEntry, error) {
+	var es []cacheEntry
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // removed concurrently
+		}
+		es = append(es, cacheEntry{path, info.Size(), info.ModTime()})
+		return nil
+	})
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].modTime.Before(es[j].modTime)
+	})
+	return es, err
+}
+
+// prune removes expired entries, and then the oldest entries in excess of the
+// size limit.
+func (c *resultCache) prune() (removed int, err error) {
+	es, err := c.entries()
+	if err != nil {
+		return 0, err
+	}
+	for i, e := range es {
+		expired := c.ttl > 0 && time.Since(e.modTime) > c.ttl
+		excess := c.maxEntries > 0 && len(es)-i > c.maxEntries
+		if !expired && !excess {
+			break
+		} else if err := os.Remove(e.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// clear removes every entry in the cache.
+func (c *resultCache) clear() (removed int, err error) {
+	es, err := c.entries()
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range es {
+		if err := os.Remove(e.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// newResultCache returns a cache that stores results in dir. Results are
+// additionally keyed by backend, so that different backends don't share
+// results. If ttl or maxEntries are zero, the corresponding limit is disabled.
+func newResultCache(dir, backend string, ttl time.Duration, maxEntries int) *resultCache {
+	return &resultCache{
+		dir:        dir,
+		backend:    backend,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		hashes:     make(map[string]cachedHash),
+	}
+}
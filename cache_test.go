@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"lukechampine.com/barbershop/shazam"
+)
+
+func TestResultCacheConcurrentPut(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "track.wav")
+	if err := os.WriteFile(path, []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newResultCache(filepath.Join(dir, "cache"), "test", time.Hour, 0)
+	params := newIdentifyParams(1, 1, 0)
+	res := shazam.Result{Found: true, Artist: "Artist", Title: "Title"}
+
+	// concurrent writes of the same entry must not collide
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*20)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				errs <- c.put(path, params, clipDuration, res)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, ok := c.get(path, params, clipDuration); !ok || got.Title != res.Title {
+		t.Fatalf("expected cached result, got %v", got)
+	} else if es, err := c.entries(); err != nil {
+		t.Fatal(err)
+	} else if len(es) != 1 {
+		t.Fatalf("expected 1 entry, got %v", len(es))
+	}
+	tmps, _ := filepath.Glob(filepath.Join(dir, "cache", "*", "*.tmp"))
+	if len(tmps) != 0 {
+		t.Fatalf("temporary files were left behind: %v", tmps)
+	}
+}
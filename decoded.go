@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/faiface/beep"
+)
+
+// A decodedAudio is an audio track decoded into memory as mono float32
+// samples, so that identification and playback can seek within it freely
+// without decoding it again.
+type decodedAudio struct {
+	format  beep.Format
+	samples []float32
+}
+
+// Len returns the number of samples in the track.
+func (a *decodedAudio) Len() int {
+	return len(a.samples)
+}
+
+// read copies samples [pos, end) into samples, returning the number copied.
+func (a *decodedAudio) read(samples [][2]float64, pos, end int) int {
+	n := min(len(samples), max(end-pos, 0))
+	for i, s := range a.samples[pos : pos+n] {
+		samples[i] = [2]float64{float64(s), float64(s)}
+	}
+	return n
+}
+
+// cursor returns a new streamer positioned at the start of the track.
+func (a *decodedAudio) cursor() *audioCursor {
+	return &audioCursor{a: a}
+}
+
+// An audioCursor streams a decodedAudio from an independent position.
+type audioCursor struct {
+	a   *decodedAudio
+	pos int
+}
+
+func (c *audioCursor) Stream(samples [][2]float64) (n int, ok bool) {
+	n = c.a.read(samples, c.pos, c.a.Len())
+	c.pos += n
+	return n, n > 0
+}
+
+func (c *audioCursor) Err() error {
+	return nil
+}
+
+func (c *audioCursor) Len() int {
+	return c.a.Len()
+}
+
+func (c *audioCursor) Position() int {
+	return c.pos
+}
+
+func (c *audioCursor) Close() error {
+	return nil
+}
+
+func (c *audioCursor) Seek(p int) error {
+	c.pos = max(0, min(p, c.a.Len()))
+	return nil
+}
+
+// decodeStream decodes the remainder of stream into memory, mixing it down to
+// mono.
+func decodeStream(format beep.Format, stream beep.Streamer) (*decodedAudio, error) {
+	a := &decodedAudio{format: format}
+	a.format.NumChannels = 1
+	var buf [4096][2]float64
+	for {
+		n, ok := stream.Stream(buf[:])
+		for _, s := range buf[:n] {
+			a.samples = append(a.samples, float32((s[0]+s[1])/2))
+		}
+		if !ok {
+			break
+		}
+	}
+	return a, stream.Err()
+}
+
+// maxDecodedSize is the approximate number of bytes of decoded audio kept in
+// memory for reuse.
+var maxDecodedSize int64 = 256 << 20
+
+type decodedEntry struct {
+	modTime time.Time
+	size    int64
+	ready   chan struct{}
+	a       *decodedAudio
+	err     error
+	used    time.Time
+}
+
+var decodedCache = struct {
+	sync.Mutex
+	m map[string]*decodedEntry
+}{m: make(map[string]*decodedEntry)}
+
+// loadAudio returns the audio of the file at path, decoded as 16 kHz mono.
+// Recently loaded files are kept in memory, and concurrent loads of the same
+// file share a single decode.
+func loadAudio(path string) (*decodedAudio, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	decodedCache.Lock()
+	e, ok := decodedCache.m[path]
+	if !ok || !e.modTime.Equal(stat.ModTime()) || e.size != stat.Size() {
+		e = &decodedEntry{modTime: stat.ModTime(), size: stat.Size(), ready: make(chan struct{})}
+		decodedCache.m[path] = e
+		decodedCache.Unlock()
+		a, err := decodeFile(path)
+		decodedCache.Lock()
+		e.a, e.err = a, err
+		close(e.ready)
+		if e.err != nil && decodedCache.m[path] == e {
+			delete(decodedCache.m, path)
+		}
+		evictDecoded(path)
+	}
+	e.used = time.Now()
+	decodedCache.Unlock()
+	<-e.ready
+	return e.a, e.err
+}
+
+func decodeFile(path string) (*decodedAudio, error) {
+	stream, format, err := openStreamer(path)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	var s beep.Streamer = stream
+	if format.SampleRate != 16000 {
+		s = beep.Resample(6, format.SampleRate, 16000, stream)
+	}
+	format.SampleRate = 16000
+	return decodeStream(format, s)
+}
+
+// evictDecoded removes the least recently used decoded audio from the cache
+// until it fits within maxDecodedSize. The entry for keep, which was just
+// loaded, is never evicted, even if it alone exceeds the limit. The cache must
+// be locked.
+func evictDecoded(keep string) {
+	for {
+		var total int64
+		var lru string
+		for path, e := range decodedCache.m {
+			if e.a == nil {
+				continue // still decoding
+			}
+			total += int64(e.a.Len()) * 4
+			if path == keep {
+				continue
+			}
+			if lru == "" || e.used.Before(decodedCache.m[lru].used) {
+				lru = path
+			}
+		}
+		if total <= maxDecodedSize || lru == "" {
+			return
+		}
+		delete(decodedCache.m, lru)
+	}
+}
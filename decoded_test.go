@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lukechampine.com/barbershop/shazam/shazamtest"
+)
+
+func TestLoadAudioOversized(t *testing.T) {
+	old := maxDecodedSize
+	maxDecodedSize = 1000
+	t.Cleanup(func() { maxDecodedSize = old })
+
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.wav"), filepath.Join(dir, "b.wav")
+	writeWAV(t, a, 16000, shazamtest.Synthesize(1, 16000, 2*time.Second))
+	writeWAV(t, b, 16000, shazamtest.Synthesize(2, 16000, 2*time.Second))
+
+	// a file larger than the limit should still be decoded only once
+	first, err := loadAudio(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := loadAudio(a); err != nil {
+		t.Fatal(err)
+	} else if again != first {
+		t.Fatal("expected oversized file to be decoded only once")
+	}
+
+	// loading another file should evict it, but keep the new one
+	other, err := loadAudio(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loadAudio(b); again != other {
+		t.Fatal("expected most recently loaded file to be kept")
+	} else if again, _ := loadAudio(a); again == first {
+		t.Fatal("expected least recently used file to be evicted")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloads stores audio fetched from remote URIs.
+var downloads = newDownloadCache(defaultDownloadDir(), 0)
+
+// A downloadCache stores downloaded audio in a directory, keyed by source ID.
+// Each entry is a subdirectory containing the downloaded files, alongside a
+// JSON sidecar describing them. When the cache exceeds its size limit, the
+// least recently used entries are evicted.
+type downloadCache struct {
+	dir     string
+	maxSize int64 // in bytes; 0 means unlimited
+
+	mu        sync.Mutex
+	locks     map[string]*keyLock // held while an entry is being downloaded
+	inUse     map[string]int      // entries fetched by jobs that are still running
+	discarded map[string]bool     // in-use entries to remove once released
+}
+
+// A keyLock serializes fetches of a single key.
+type keyLock struct {
+	sync.Mutex
+	refs int // fetches holding or waiting for the lock
+}
+
+// downloadMeta is the sidecar for a downloadCache entry.
+type downloadMeta struct {
+	Source   string    `json:"source"`
+	Title    string    `json:"title"`
+	Duration float64   `json:"duration,omitempty"` // in seconds
+	Size     int64     `json:"size"`
+	Fetched  time.Time `json:"fetched"`
+	Accessed time.Time `json:"accessed"`
+}
+
+func defaultDownloadDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "barbershop", "downloads")
+}
+
+func (dc *downloadCache) entryDir(key string) string {
+	return filepath.Join(dc.dir, key)
+}
+
+func (dc *downloadCache) metaPath(key string) string {
+	return filepath.Join(dc.dir, key+".json")
+}
+
+func (dc *downloadCache) lockKey(key string) {
+	dc.mu.Lock()
+	l, ok := dc.locks[key]
+	if !ok {
+		l = new(keyLock)
+		dc.locks[key] = l
+	}
+	l.refs++
+	dc.mu.Unlock()
+	l.Lock()
+}
+
+// unlockKey releases the lock acquired by lockKey, forgetting it once no other
+// fetches are waiting for it.
+func (dc *downloadCache) unlockKey(key string) {
+	dc.mu.Lock()
+	l := dc.locks[key]
+	if l.refs--; l.refs == 0 {
+		delete(dc.locks, key)
+	}
+	dc.mu.Unlock()
+	l.Unlock()
+}
+
+// remove deletes the entry for key. dc.mu must be held.
+func (dc *downloadCache) remove(key string) {
+	os.Remove(dc.metaPath(key))
+	os.RemoveAll(dc.entryDir(key))
+}
+
+func (dc *downloadCache) readMeta(key string) (downloadMeta, error) {
+	js, err := os.ReadFile(dc.metaPath(key))
+	if err != nil {
+		return downloadMeta{}, err
+	}
+	var meta downloadMeta
+	err = json.Unmarshal(js, &meta)
+	return meta, err
+}
+
+func (dc *downloadCache) writeMeta(key string, meta downloadMeta) error {
+	js, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dc.metaPath(key), js)
+}
+
+// fetch returns the directory containing the entry for key, calling download
+// to populate it if necessary. Concurrent fetches of the same key wait for a
+// single download. The entry is protected from eviction until release is
+// called with the same key.
+func (dc *downloadCache) fetch(key, source, title string, download func(dir string) error) (string, error) {
+	dc.lockKey(key)
+	defer dc.unlockKey(key)
+	dc.mu.Lock()
+	dc.inUse[key]++
+	discarded := dc.discarded[key]
+	dc.mu.Unlock()
+
+	dir := dc.entryDir(key)
+	if meta, err := dc.readMeta(key); err == nil && !discarded {
+		if _, err := os.Stat(dir); err == nil {
+			meta.Accessed = time.Now()
+			dc.writeMeta(key, meta) // LRU tracking is best-effort
+			return dir, nil
+		}
+	}
+
+	if err := os.MkdirAll(dc.dir, 0755); err != nil {
+		dc.release(key)
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(dc.dir, key+".*.tmp")
+	if err != nil {
+		dc.release(key)
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := download(tmp); err != nil {
+		dc.release(key)
+		return "", err
+	}
+	os.RemoveAll(dir)
+	if err := os.Rename(tmp, dir); err != nil {
+		dc.release(key)
+		return "", err
+	}
+	meta := downloadMeta{
+		Source:   source,
+		Title:    title,
+		Size:     dirSize(dir),
+		Fetched:  time.Now(),
+		Accessed: time.Now(),
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.wav"))
+	for _, file := range files {
+		if stream, format, err := openStreamer(file); err == nil {
+			meta.Duration += format.SampleRate.D(stream.Len()).Seconds()
+			stream.Close()
+		}
+	}
+	if err := dc.writeMeta(key, meta); err != nil {
+		dc.release(key)
+		return "", err
+	}
+	dc.mu.Lock()
+	delete(dc.discarded, key)
+	dc.mu.Unlock()
+	dc.evict()
+	return dir, nil
+}
+
+// release marks an entry returned by fetch as no longer in use. If the entry
+// was discarded, it is removed once its last user releases it.
+func (dc *downloadCache) release(key string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.inUse[key]--; dc.inUse[key] <= 0 {
+		delete(dc.inUse, key)
+		if dc.discarded[key] {
+			delete(dc.discarded, key)
+			dc.remove(key)
+		}
+	}
+}
+
+// pathKey returns the key of the entry containing path, if any.
+func (dc *downloadCache) pathKey(path string) (string, bool) {
+	rel, err := filepath.Rel(dc.dir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return strings.Split(filepath.ToSlash(rel), "/")[0], true
+}
+
+// releaser returns a function that releases the entry for key the first time
+// it is called, so that callers may release an entry on several paths.
+func (dc *downloadCache) releaser(key string) func() {
+	return sync.OnceFunc(func() { dc.release(key) })
+}
+
+// discardPath removes the entry containing path, e.g. because it turned out to
+// be corrupt, so that the next fetch downloads it again. If the entry is in
+// use, it is removed when released instead.
+func (dc *downloadCache) discardPath(path string) {
+	if key, ok := dc.pathKey(path); ok {
+		dc.mu.Lock()
+		defer dc.mu.Unlock()
+		if dc.inUse[key] > 0 {
+			dc.discarded[key] = true
+		} else {
+			dc.remove(key)
+		}
+	}
+}
+
+type downloadEntry struct {
+	key  string
+	meta downloadMeta
+}
+
+// entries returns the cache's entries, least recently used first.
+func (dc *downloadCache) entries() ([]downloadEntry, error) {
+	files, err := os.ReadDir(dc.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var es []downloadEntry
+	for _, f := range files {
+		key, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok || f.IsDir() {
+			continue
+		}
+		if meta, err := dc.readMeta(key); err == nil {
+			es = append(es, downloadEntry{key, meta})
+		}
+	}
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].meta.Accessed.Before(es[j].meta.Accessed)
+	})
+	return es, nil
+}
+
+// evict removes the least recently used entries until the cache fits within
+// its size limit. Entries that are in use are never evicted.
+func (dc *downloadCache) evict() {
+	if dc.maxSize <= 0 {
+		return
+	}
+	es, err := dc.entries()
+	if err != nil {
+		return
+	}
+	var total int64
+	for _, e := range es {
+		total += e.meta.Size
+	}
+	for _, e := range es {
+		if total <= dc.maxSize {
+			break
+		}
+		dc.mu.Lock()
+		if dc.inUse[e.key] == 0 {
+			dc.remove(e.key)
+			total -= e.meta.Size
+		}
+		dc.mu.Unlock()
+	}
+}
+
+func dirSize(dir string) (size int64) {
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+func newDownloadCache(dir string, maxSize int64) *downloadCache {
+	return &downloadCache{
+		dir:       dir,
+		maxSize:   maxSize,
+		locks:     make(map[string]*keyLock),
+		inUse:     make(map[string]int),
+		discarded: make(map[string]bool),
+	}
+}
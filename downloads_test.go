@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDownloadCache(t *testing.T) {
+	dc := newDownloadCache(t.TempDir(), 1500)
+	var fetched atomic.Int32
+	download := func(dir string) error {
+		fetched.Add(1)
+		return os.WriteFile(filepath.Join(dir, "audio.wav"), make([]byte, 1000), 0644)
+	}
+
+	// concurrent fetches should share a single download
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := dc.fetch("a", "https://example.com/a", "a", download); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fetched.Load(); n != 1 {
+		t.Fatalf("expected 1 download, got %v", n)
+	}
+	for i := 0; i < 4; i++ {
+		dc.release("a")
+	}
+
+	// in-use entries should not be evicted
+	dir, err := dc.fetch("b", "https://example.com/b", "b", download)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := dc.fetch("c", "https://example.com/c", "c", download); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dc.entryDir("a")); err == nil {
+		t.Fatal("expected least recently used entry to be evicted")
+	} else if _, err := os.Stat(dir); err != nil {
+		t.Fatal("in-use entry was evicted")
+	}
+	es, err := dc.entries()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(es) != 2 || es[0].meta.Source != "https://example.com/b" {
+		t.Fatalf("unexpected entries: %+v", es)
+	}
+}
+
+func TestDownloadCacheDiscard(t *testing.T) {
+	dc := newDownloadCache(t.TempDir(), 0)
+	var fetched atomic.Int32
+	download := func(dir string) error {
+		fetched.Add(1)
+		return os.WriteFile(filepath.Join(dir, "audio.wav"), make([]byte, 1000), 0644)
+	}
+	dir, err := dc.fetch("a", "https://example.com/a", "a", download)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := dc.fetch("a", "https://example.com/a", "a", download); err != nil {
+		t.Fatal(err)
+	} else if len(dc.locks) != 0 {
+		t.Fatalf("expected key locks to be pruned, got %v", len(dc.locks))
+	}
+
+	// discarding an in-use entry should defer its removal until it is released
+	path := filepath.Join(dir, "audio.wav")
+	dc.discardPath(path)
+	dc.release("a")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("in-use entry was removed")
+	}
+	dc.release("a")
+	if _, err := os.Stat(dir); err == nil {
+		t.Fatal("expected discarded entry to be removed")
+	}
+	if _, err := dc.fetch("a", "https://example.com/a", "a", download); err != nil {
+		t.Fatal(err)
+	} else if n := fetched.Load(); n != 2 {
+		t.Fatalf("expected discarded entry to be downloaded again, got %v downloads", n)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"sort"
+
+	"gonum.org/v1/gonum/dsp/fourier"
+)
+
+func hannWindow(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n))
+	}
+	return w
+}
+
+// timeStretch changes the tempo of x without affecting its pitch, using WSOLA
+// (waveform-similarity overlap-add). A tempo greater than 1 speeds x up.
+func timeStretch(x []float64, tempo float64) []float64 {
+	const (
+		frameLen  = 1024 // 64ms at 16 kHz
+		synHop    = frameLen / 2
+		tolerance = 256
+	)
+	if tempo == 1 || len(x) < frameLen {
+		return x
+	}
+	window := hannWindow(frameLen)
+	outLen := int(float64(len(x)) / tempo)
+	out := make([]float64, outLen+frameLen)
+	norm := make([]float64, outLen+frameLen)
+
+	// bestAlignment returns the position near pos whose first half best
+	// matches the second half of the frame at prev; this keeps successive
+	// frames in phase, avoiding the "phasiness" of plain overlap-add
+	bestAlignment := func(prev, pos int) int {
+		natural := prev + synHop
+		best, bestCorr := pos, math.Inf(-1)
+		for cand := max(0, pos-tolerance); cand <= min(pos+tolerance, len(x)-frameLen); cand++ {
+			var corr float64
+			for i := 0; i < synHop; i++ {
+				corr += x[natural+i] * x[cand+i]
+			}
+			if corr > bestCorr {
+				best, bestCorr = cand, corr
+			}
+		}
+		return best
+	}
+
+	prev := 0
+	for k := 0; k*synHop < outLen; k++ {
+		// once x runs out, keep emitting (aligned) frames from its end, so
+		// that the tail of the output is fully overlap-added rather than left
+		// silent
+		pos := min(int(float64(k*synHop)*tempo), len(x)-frameLen)
+		if k > 0 && prev+synHop+synHop <= len(x) {
+			pos = bestAlignment(prev, pos)
+		}
+		for i, w := range window {
+			out[k*synHop+i] += x[pos+i] * w
+			norm[k*synHop+i] += w
+		}
+		prev = pos
+	}
+	for i := range out {
+		if norm[i] > 1e-3 {
+			out[i] /= norm[i]
+		}
+	}
+	return out[:outLen]
+}
+
+// resampleLinear changes the speed (and pitch) of x by ratio, using linear
+// interpolation. When speeding up, x is first low-passed below the new Nyquist
+// frequency, so that the highest frequencies don't alias.
+func resampleLinear(x []float64, ratio float64) []float64 {
+	if ratio > 1 {
+		// a 4th-order Butterworth filter; frequencies are in cycles per sample
+		cutoff := 0.45 / ratio
+		x = lowPass(cutoff, 0.541, 1).apply(x)
+		x = lowPass(cutoff, 1.307, 1).apply(x)
+	}
+	out := make([]float64, int(float64(len(x))/ratio))
+	for i := range out {
+		t := float64(i) * ratio
+		j := int(t)
+		frac := t - float64(j)
+		if j+1 < len(x) {
+			out[i] = x[j]*(1-frac) + x[j+1]*frac
+		} else if j < len(x) {
+			out[i] = x[j]
+		}
+	}
+	return out
+}
+
+// pitchShift shifts the pitch of x by the specified number of semitones,
+// without affecting its tempo.
+func pitchShift(x []float64, semitones float64) []float64 {
+	if semitones == 0 {
+		return x
+	}
+	ratio := math.Pow(2, semitones/12)
+	return resampleLinear(timeStretch(x, 1/ratio), ratio)
+}
+
+// detectTempo estimates the tempo of x, in beats per minute, using spectral
+// flux onset detection followed by autocorrelation. It returns 0 if x is too
+// short to analyze.
+func detectTempo(x []float64, sampleRate int) float64 {
+	const (
+		frameLen = 1024
+		hop      = 128
+	)
+	frameRate := float64(sampleRate) / hop
+	if len(x) < frameLen || float64(len(x))/hop < 4*frameRate {
+		return 0
+	}
+
+	// compute onset strength as the sum of positive changes in log magnitude
+	fft := fourier.NewFFT(frameLen)
+	window := hannWindow(frameLen)
+	frame := make([]float64, frameLen)
+	coeffs := make([]complex128, frameLen/2+1)
+	mags := make([]float64, len(coeffs))
+	prev := make([]float64, len(coeffs))
+	var onsets []float64
+	for i := 0; i+frameLen <= len(x); i += hop {
+		for j, w := range window {
+			frame[j] = x[i+j] * w
+		}
+		fft.Coefficients(coeffs, frame)
+		var flux float64
+		for j, c := range coeffs {
+			mags[j] = math.Log1p(100 * cmplx.Abs(c))
+			flux += max(0, mags[j]-prev[j])
+		}
+		if i > 0 {
+			onsets = append(onsets, flux)
+		}
+		prev, mags = mags, prev
+	}
+	// subtract the local mean, leaving only the peaks
+	const meanWindow = 16
+	peaks := make([]float64, len(onsets))
+	var sum float64
+	for i, o := range onsets {
+		sum += o
+		if i >= meanWindow {
+			sum -= onsets[i-meanWindow]
+		}
+		peaks[i] = max(0, o-sum/float64(min(i+1, meanWindow)))
+	}
+
+	// find the lag with the strongest autocorrelation, weighted towards
+	// moderate tempos to avoid locking onto multiples of the beat
+	minLag := int(frameRate * 60 / 240)
+	maxLag := int(frameRate * 60 / 40)
+	if maxLag+2 >= len(peaks) {
+		return 0
+	}
+	acf := make([]float64, maxLag+2)
+	for lag := minLag - 1; lag < len(acf); lag++ {
+		for i := lag; i < len(peaks); i++ {
+			acf[lag] += peaks[i] * peaks[i-lag]
+		}
+		acf[lag] /= float64(len(peaks) - lag)
+	}
+	bestLag, bestScore := 0, 0.0
+	for lag := minLag; lag <= maxLag; lag++ {
+		bpm := 60 * frameRate / float64(lag)
+		weight := math.Exp(-0.5 * math.Pow(math.Log2(bpm/120), 2))
+		if score := acf[lag] * weight; score > bestScore {
+			bestLag, bestScore = lag, score
+		}
+	}
+	if bestLag == 0 {
+		return 0
+	}
+	// refine the peak with parabolic interpolation
+	lag := float64(bestLag)
+	if a, b, c := acf[bestLag-1], acf[bestLag], acf[bestLag+1]; a-2*b+c != 0 {
+		lag += 0.5 * (a - c) / (a - 2*b + c)
+	}
+	return 60 * frameRate / lag
+}
+
+// A biquad is a second-order IIR filter, with coefficients normalized so that
+// a0 = 1. The constructors follow the RBJ audio EQ cookbook.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+}
+
+func newBiquad(b0, b1, b2, a0, a1, a2 float64) biquad {
+	return biquad{b0 / a0, b1 / a0, b2 / a0, a1 / a0, a2 / a0}
+}
+
+// highPass returns a filter that attenuates frequencies below freq.
+func highPass(freq, q float64, sampleRate int) biquad {
+	w0 := 2 * math.Pi * freq / float64(sampleRate)
+	cos, alpha := math.Cos(w0), math.Sin(w0)/(2*q)
+	return newBiquad((1+cos)/2, -(1 + cos), (1+cos)/2, 1+alpha, -2*cos, 1-alpha)
+}
+
+// lowPass returns a filter that attenuates frequencies above freq.
+func lowPass(freq, q float64, sampleRate int) biquad {
+	w0 := 2 * math.Pi * freq / float64(sampleRate)
+	cos, alpha := math.Cos(w0), math.Sin(w0)/(2*q)
+	return newBiquad((1-cos)/2, 1-cos, (1-cos)/2, 1+alpha, -2*cos, 1-alpha)
+}
+
+// peakingEQ returns a filter that boosts (or cuts) frequencies around freq by
+// gain decibels.
+func peakingEQ(freq, q, gain float64, sampleRate int) biquad {
+	w0 := 2 * math.Pi * freq / float64(sampleRate)
+	cos, alpha := math.Cos(w0), math.Sin(w0)/(2*q)
+	a := math.Pow(10, gain/40)
+	return newBiquad(1+alpha*a, -2*cos, 1-alpha*a, 1+alpha/a, -2*cos, 1-alpha/a)
+}
+
+// highShelf returns a filter that boosts (or cuts) frequencies above freq by
+// gain decibels.
+func highShelf(freq, gain float64, sampleRate int) biquad {
+	w0 := 2 * math.Pi * freq / float64(sampleRate)
+	cos, alpha := math.Cos(w0), math.Sin(w0)/math.Sqrt2
+	a := math.Pow(10, gain/40)
+	sa := 2 * math.Sqrt(a) * alpha
+	return newBiquad(
+		a*((a+1)+(a-1)*cos+sa), -2*a*((a-1)+(a+1)*cos), a*((a+1)+(a-1)*cos-sa),
+		(a+1)-(a-1)*cos+sa, 2*((a-1)-(a+1)*cos), (a+1)-(a-1)*cos-sa,
+	)
+}
+
+// apply returns x filtered by f.
+func (f biquad) apply(x []float64) []float64 {
+	out := make([]float64, len(x))
+	var x1, x2, y1, y2 float64
+	for i, x0 := range x {
+		y0 := f.b0*x0 + f.b1*x1 + f.b2*x2 - f.a1*y1 - f.a2*y2
+		out[i] = y0
+		x1, x2 = x0, x1
+		y1, y2 = y0, y1
+	}
+	return out
+}
+
+const (
+	stftLen = 1024
+	stftHop = stftLen / 4
+)
+
+// stft returns the short-time Fourier transform of x. x is padded so that
+// every sample is covered by the same number of frames.
+func stft(x []float64) [][]complex128 {
+	padded := make([]float64, len(x)+2*stftLen)
+	copy(padded[stftLen:], x)
+	fft := fourier.NewFFT(stftLen)
+	window := hannWindow(stftLen)
+	frame := make([]float64, stftLen)
+	var frames [][]complex128
+	for i := 0; i+stftLen <= len(padded); i += stftHop {
+		for j, w := range window {
+			frame[j] = padded[i+j] * w
+		}
+		frames = append(frames, fft.Coefficients(nil, frame))
+	}
+	return frames
+}
+
+// istft inverts stft, returning n samples.
+func istft(frames [][]complex128, n int) []float64 {
+	fft := fourier.NewFFT(stftLen)
+	window := hannWindow(stftLen)
+	out := make([]float64, n+2*stftLen)
+	norm := make([]float64, len(out))
+	frame := make([]float64, stftLen)
+	for k, coeffs := range frames {
+		fft.Sequence(frame, coeffs)
+		for j, w := range window {
+			out[k*stftHop+j] += frame[j] * w / stftLen
+			norm[k*stftHop+j] += w * w
+		}
+	}
+	for i := range out {
+		if norm[i] > 1e-3 {
+			out[i] /= norm[i]
+		}
+	}
+	return out[stftLen : stftLen+n]
+}
+
+func magnitudes(frames [][]complex128) [][]float64 {
+	mags := make([][]float64, len(frames))
+	for i, f := range frames {
+		mags[i] = make([]float64, len(f))
+		for j, c := range f {
+			mags[i][j] = cmplx.Abs(c)
+		}
+	}
+	return mags
+}
+
+func median(xs []float64) float64 {
+	sort.Float64s(xs)
+	return xs[len(xs)/2]
+}
+
+// suppressPercussion removes transients such as drums from x, using
+// median-filtering harmonic-percussive separation: sustained tones are smooth
+// across time, whereas hits are smooth across frequency.
+func suppressPercussion(x []float64) []float64 {
+	const kernel = 17
+	frames := stft(x)
+	mags := magnitudes(frames)
+	buf := make([]float64, 0, kernel)
+	for t, f := range frames {
+		for k := range f {
+			buf = buf[:0]
+			for i := max(0, t-kernel/2); i <= min(len(mags)-1, t+kernel/2); i++ {
+				buf = append(buf, mags[i][k])
+			}
+			h := median(buf)
+			buf = buf[:0]
+			for i := max(0, k-kernel/2); i <= min(len(f)-1, k+kernel/2); i++ {
+				buf = append(buf, mags[t][i])
+			}
+			p := median(buf)
+			// soft (Wiener) mask
+			if h2, p2 := h*h, p*p; h2+p2 > 0 {
+				f[k] *= complex(h2/(h2+p2), 0)
+			}
+		}
+	}
+	return istft(frames, len(x))
+}
+
+// spectralGate attenuates steady background noise, such as hiss, rain, or
+// vinyl crackle, in x. The noise floor of each frequency bin is estimated from
+// its quietest frames, and energy near the floor is suppressed.
+func spectralGate(x []float64) []float64 {
+	const (
+		percentile = 0.1
+		threshold  = 2   // multiple of the noise floor
+		floorGain  = 0.1 // gain applied to pure noise
+	)
+	frames := stft(x)
+	if len(frames) == 0 {
+		return x
+	}
+	mags := magnitudes(frames)
+	nbins := len(frames[0])
+	noise := make([]float64, nbins)
+	col := make([]float64, len(frames))
+	for k := range noise {
+		for t := range mags {
+			col[t] = mags[t][k]
+		}
+		sort.Float64s(col)
+		noise[k] = col[int(percentile*float64(len(col)-1))]
+	}
+	// smooth gains across time to avoid "musical noise"
+	prev := make([]float64, nbins)
+	for k := range prev {
+		prev[k] = 1
+	}
+	for t, f := range frames {
+		for k := range f {
+			g := floorGain
+			if m := mags[t][k]; m > 0 {
+				r := threshold * noise[k] / m
+				g = max(floorGain, 1-r*r)
+			}
+			g = (g + prev[k]) / 2
+			prev[k] = g
+			f[k] *= complex(g, 0)
+		}
+	}
+	return istft(frames, len(x))
+}
+
+// removeLowPass undoes low-pass filtering of x by flattening its long-term
+// spectrum: frequencies above the midrange that are quieter than it are boosted
+// to match, by up to 24 dB.
+func removeLowPass(x []float64, sampleRate int) []float64 {
+	const (
+		refLo, refHi = 250, 1000 // reference band, in Hz
+		maxGain      = 16        // 24 dB
+	)
+	frames := stft(x)
+	if len(frames) == 0 {
+		return x
+	}
+	mags := magnitudes(frames)
+	nbins := len(frames[0])
+	binHz := float64(sampleRate) / stftLen
+	avg := make([]float64, nbins)
+	for _, m := range mags {
+		for k, v := range m {
+			avg[k] += v / float64(len(mags))
+		}
+	}
+	var ref float64
+	lo, hi := int(refLo/binHz), int(refHi/binHz)
+	for _, v := range avg[lo:hi] {
+		ref += v / float64(hi-lo)
+	}
+	gains := make([]float64, nbins)
+	for k := range gains {
+		gains[k] = 1
+		if k >= hi && avg[k] > 0 && avg[k] < ref {
+			gains[k] = min(ref/avg[k], maxGain)
+		}
+	}
+	for _, f := range frames {
+		for k := range f {
+			f[k] *= complex(gains[k], 0)
+		}
+	}
+	return istft(frames, len(x))
+}
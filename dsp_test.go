@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// clickTrack returns d seconds of clicks at the given tempo.
+func clickTrack(bpm float64, sampleRate int, d float64) []float64 {
+	x := make([]float64, int(d*float64(sampleRate)))
+	period := 60 / bpm * float64(sampleRate)
+	for beat := 0.0; int(beat) < len(x); beat += period {
+		for i := 0; i < sampleRate/50 && int(beat)+i < len(x); i++ {
+			t := float64(i) / float64(sampleRate)
+			x[int(beat)+i] = math.Sin(2*math.Pi*1000*t) * math.Exp(-t*200)
+		}
+	}
+	return x
+}
+
+func TestDetectTempo(t *testing.T) {
+	tests := []struct {
+		bpm, want float64
+	}{
+		{60, 60},
+		{90, 90},
+		{120, 120},
+		{137.5, 137.5},
+		{175, 175},
+		{230, 115}, // fast tempos are detected at half speed
+	}
+	for _, test := range tests {
+		if got := detectTempo(clickTrack(test.bpm, 16000, 20), 16000); math.Abs(got-test.want) > 1 {
+			t.Errorf("%v BPM: expected %v, got %v", test.bpm, test.want, got)
+		}
+	}
+	if bpm := detectTempo(clickTrack(120, 16000, 1), 16000); bpm != 0 {
+		t.Errorf("expected 0 for a short clip, got %v", bpm)
+	}
+}
+
+func TestTempoPrior(t *testing.T) {
+	// a 110 BPM source sped up by 1.25, detected at its true tempo and at
+	// half and double tempo; 1.25 should be preferred over no speedup in
+	// every case
+	for _, bpm := range []float64{137.5, 137.5 / 2, 137.5 * 2} {
+		if p, q := tempoPrior(bpm, 1.25), tempoPrior(bpm, 1); p >= q {
+			t.Errorf("%v BPM: expected speed 1.25 (%v) to be more likely than 1 (%v)", bpm, p, q)
+		}
+	}
+	if p := tempoPrior(137.5, 1.25); p != 0 {
+		t.Errorf("expected a typical source tempo to have no penalty, got %v", p)
+	} else if q := tempoPrior(137.5/2, 1.25); q <= p {
+		t.Errorf("expected an octave error to be penalized, got %v", q)
+	}
+}
+
+// rms returns the root mean square of x.
+func rms(x []float64) float64 {
+	var sum float64
+	for _, v := range x {
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(x)))
+}
+
+func sine(freq float64, sampleRate, n int) []float64 {
+	x := make([]float64, n)
+	for i := range x {
+		x[i] = math.Sin(2 * math.Pi * freq * float64(i) / float64(sampleRate))
+	}
+	return x
+}
+
+func TestResampleLinearAliasing(t *testing.T) {
+	// speeding up by 1.5 moves 7 kHz past the 8 kHz Nyquist frequency, where
+	// it would alias to 5.5 kHz; 1 kHz should be unaffected
+	if r := rms(resampleLinear(sine(7000, 16000, 16000), 1.5)); r > 0.05 {
+		t.Errorf("expected 7 kHz to be filtered out, got RMS %v", r)
+	}
+	if r := rms(resampleLinear(sine(1000, 16000, 16000), 1.5)); math.Abs(r-math.Sqrt2/2) > 0.02 {
+		t.Errorf("expected 1 kHz to pass through, got RMS %v", r)
+	}
+}
+
+func TestTimeStretchTail(t *testing.T) {
+	x := sine(440, 16000, 16000)
+	for _, tempo := range []float64{0.8, 1.1, 1.3} {
+		out := timeStretch(x, tempo)
+		// the end of the output should not be silent
+		if r := rms(out[len(out)-1600:]); math.Abs(r-math.Sqrt2/2) > 0.1 {
+			t.Errorf("tempo %v: expected tail RMS %v, got %v", tempo, math.Sqrt2/2, r)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/bubbles/spinner"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/julienschmidt/httprouter"
+	"lukechampine.com/barbershop/shazam"
+	"lukechampine.com/barbershop/shazam/shazamtest"
+)
+
+const testSpeedup = 1.25
+
+var testSong = shazamtest.Song{
+	Artist:  "Mariya Takeuchi",
+	Title:   "Plastic Love",
+	Album:   "Variety",
+	Year:    "1984",
+	Genre:   "J-Pop",
+	Label:   "Alfa Moon",
+	ISRC:    "JPB600400441",
+	AppleID: "1234",
+	Links:   map[string]string{"youtube": "https://www.youtube.com/watch?v=3bNITQR4Uso"},
+}
+
+// writeWAV writes samples to path as 16-bit mono PCM.
+func writeWAV(t *testing.T, path string, sampleRate int, samples []float64) {
+	t.Helper()
+	pcm := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(int16(max(-1, min(1, s))*math.MaxInt16)))
+	}
+	var hdr [44]byte
+	copy(hdr[0:], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(36+len(pcm)))
+	copy(hdr[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(hdr[16:], 16)
+	binary.LittleEndian.PutUint16(hdr[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(hdr[22:], 1) // mono
+	binary.LittleEndian.PutUint32(hdr[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(hdr[28:], uint32(2*sampleRate))
+	binary.LittleEndian.PutUint16(hdr[32:], 2)
+	binary.LittleEndian.PutUint16(hdr[34:], 16)
+	copy(hdr[36:], "data")
+	binary.LittleEndian.PutUint32(hdr[40:], uint32(len(pcm)))
+	if err := os.WriteFile(path, append(hdr[:], pcm...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testSource returns the audio of testSong.
+func testSource() []float64 {
+	return shazamtest.Synthesize(1, 16000, 100*time.Second)
+}
+
+// newTestEnv starts a fake Shazam server that knows testSong, and writes a
+// track to dir that samples it, slowed down by testSpeedup.
+func newTestEnv(t *testing.T, dir string) (*shazamtest.Server, string) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+	t.Parallel()
+	srv := shazamtest.NewServer()
+	t.Cleanup(srv.Close)
+	source := testSource()
+	if err := srv.AddSong(testSong, shazam.ComputeSignature(16000, source)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "01 - sampled.wav")
+	writeWAV(t, path, 16000, resampleLinear(source, 1/testSpeedup))
+	return srv, path
+}
+
+// testOptions returns silent search options that send all requests to srv.
+func testOptions(srv *shazamtest.Server) searchOptions {
+	return searchOptions{backend: srv.Client(), links: srv.Client(), adaptive: true, parallel: 3, offline: true, silent: true}
+}
+
+// identifyTrack searches the track at path with opts.
+func identifyTrack(t *testing.T, opts searchOptions, path string) *trackIdentifier {
+	t.Helper()
+	info, err := analyzeTrack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := newTrackIdentifier(opts, info)
+	if err := id.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func checkSample(t *testing.T, id *trackIdentifier) {
+	t.Helper()
+	if id.sample == nil {
+		t.Fatal("sample not found")
+	} else if id.sample.res.Artist != testSong.Artist || id.sample.res.Title != testSong.Title {
+		t.Fatalf("wrong sample: %v - %v", id.sample.res.Artist, id.sample.res.Title)
+	} else if speed := id.sample.params.speed(); math.Abs(speed-testSpeedup) > 0.02 {
+		t.Fatalf("expected speed %v, got %v", testSpeedup, speed)
+	}
+}
+
+func TestTrackIdentifier(t *testing.T) {
+	srv, path := newTestEnv(t, t.TempDir())
+	info, err := analyzeTrack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []searchOptions{
+		{adaptive: false},
+		{adaptive: true},
+		{adaptive: true, filter: filterDrumsRemoved},
+	} {
+		// transient failures should be retried
+		srv.RateLimit(2)
+		srv.Fail(1, http.StatusBadGateway)
+		opts.backend, opts.parallel = srv.Client(), 3
+		id := newTrackIdentifier(opts, info)
+		if err := id.run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		checkSample(t, id)
+	}
+
+	// preprocessing should preserve the sample
+	p := newIdentifyParams(testSpeedup, 1, 0)
+	p.filter, p.offset = filterDrumsRemoved, 24*time.Second
+	if r, err := identifyPath(context.Background(), srv.Client(), nil, path, p); err != nil {
+		t.Fatal(err)
+	} else if !r.res.Found || r.res.Title != testSong.Title {
+		t.Fatalf("expected filtered clip to match, got %+v", r.res)
+	}
+
+	// canceling the context should abort the search
+	srv.SetLatency(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	id := newTrackIdentifier(searchOptions{backend: srv.Client(), parallel: 3}, info)
+	if err := id.run(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReversedSample(t *testing.T) {
+	srv, path := newTestEnv(t, t.TempDir())
+	// replace the track with a reversed one
+	sample := resampleLinear(testSource(), 1/testSpeedup)
+	for i, j := 0, len(sample)-1; i < j; i, j = i+1, j-1 {
+		sample[i], sample[j] = sample[j], sample[i]
+	}
+	writeWAV(t, path, 16000, sample)
+	id := identifyTrack(t, testOptions(srv), path)
+	checkSample(t, id)
+	if id.sample.params.effect != effectReverse {
+		t.Fatalf("expected reversed match, got %v", renderParams(id.sample.params))
+	}
+}
+
+func TestLowPassedSample(t *testing.T) {
+	srv, path := newTestEnv(t, t.TempDir())
+	// replace the track with a muffled one, steep enough that the unprocessed
+	// clips don't match at every offset
+	sample := resampleLinear(testSource(), 1/testSpeedup)
+	for i := 0; i < 4; i++ {
+		sample = lowPass(600, 0.707, 16000).apply(sample)
+	}
+	writeWAV(t, path, 16000, sample)
+	id := identifyTrack(t, testOptions(srv), path)
+	checkSample(t, id)
+	if e := id.sample.params.effect; e != effectUnfilter && e != effectHighShelf {
+		t.Fatalf("expected low-pass to be undone, got %v", renderParams(id.sample.params))
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	srv, path := newTestEnv(t, t.TempDir())
+	opts := testOptions(srv)
+	opts.cache = newResultCache(t.TempDir(), "test", time.Hour, 0)
+	identifyTrack(t, opts, path)
+	tags, _ := srv.Requests()
+
+	// re-running should only re-send the speculative queries that were
+	// canceled when the first run finished
+	id := identifyTrack(t, opts, path)
+	checkSample(t, id)
+	if n, _ := srv.Requests(); n-tags >= opts.parallel {
+		t.Fatalf("expected at most %v new requests, got %v (of %v)", opts.parallel-1, n-tags, tags)
+	}
+
+	// expired results should be pruned
+	opts.cache.ttl = time.Nanosecond
+	if n, err := opts.cache.prune(); err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("expected entries to be pruned")
+	}
+}
+
+func TestServerJob(t *testing.T) {
+	srv, path := newTestEnv(t, t.TempDir())
+
+	// a track that chops up two songs: testSong, then otherSong, then
+	// testSong again, each spanning whole timeline windows
+	otherSong := shazamtest.Song{Artist: "Tatsuro Yamashita", Title: "Sparkle"}
+	otherSource := shazamtest.Synthesize(2, 16000, 100*time.Second)
+	if err := srv.AddSong(otherSong, shazam.ComputeSignature(16000, otherSource)); err != nil {
+		t.Fatal(err)
+	}
+	source := testSource()
+	chop := func(src []float64, start time.Duration) []float64 {
+		// 24s of the track, slowed down by testSpeedup like newTestEnv's
+		n := int(24 * 16000 / testSpeedup)
+		i := int(start.Seconds() * 16000)
+		return resampleLinear(src[i:i+n], 1/testSpeedup)
+	}
+	chopped := filepath.Join(t.TempDir(), "chopped.wav")
+	var track []float64
+	track = append(track, chop(source, 0)...)
+	track = append(track, chop(otherSource, 10*time.Second)...)
+	track = append(track, chop(source, 50*time.Second)...)
+	writeWAV(t, chopped, 16000, track)
+
+	s := &server{
+		opts:     testOptions(srv),
+		jobs:     make(map[string]*identifyJob),
+		uriCache: map[string]mediaURI{path: mediaFile{Path: path}, chopped: mediaFile{Path: chopped}},
+		log:      io.Discard,
+	}
+
+	// run several jobs at once, polling them while they run
+	jobs := []*identifyJob{
+		{ID: jobID(path, ""), URI: path},
+		{ID: jobID(chopped, "timeline"), URI: chopped, Mode: "timeline"},
+	}
+	for _, j := range jobs {
+		s.jobs[j.ID] = j
+	}
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j *identifyJob) {
+			defer wg.Done()
+			s.doJob(context.Background(), j)
+		}(j)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for polling := true; polling; {
+		select {
+		case <-done:
+			polling = false
+		case <-time.After(10 * time.Millisecond):
+		}
+		for _, j := range jobs {
+			req := httptest.NewRequest("GET", "/job/"+j.ID, nil)
+			req.Header.Set("Accept", "application/json")
+			s.handleJob(httptest.NewRecorder(), req, httprouter.Params{{Key: "id", Value: j.ID}})
+			s.handleJob(httptest.NewRecorder(), httptest.NewRequest("GET", "/job/"+j.ID, nil), httprouter.Params{{Key: "id", Value: j.ID}})
+		}
+	}
+	j := jobs[0]
+	if j.Error != "" {
+		t.Fatal(j.Error)
+	} else if j.State != "done" || !j.Sample.Found {
+		t.Fatalf("unexpected job state: %+v", j)
+	} else if j.Sample.Artist != testSong.Artist || j.Sample.Links["YouTube"] != testSong.Links["youtube"] {
+		t.Fatalf("wrong sample: %+v", j.Sample)
+	} else if j.Sample.Genre != testSong.Genre || j.Sample.Label != testSong.Label || j.Sample.ISRC != testSong.ISRC {
+		t.Fatalf("missing metadata: %+v", j.Sample)
+	} else if want := float64(j.Sample.Params.Timestamp); math.Abs(float64(j.Sample.Offset)-want) > 1000 {
+		t.Fatalf("expected offset %vms, got %vms", want, j.Sample.Offset)
+	}
+
+	// the timeline should list both songs in order of appearance, and pick
+	// the one that spans the most of the track
+	j = jobs[1]
+	if j.Error != "" {
+		t.Fatal(j.Error)
+	}
+	if len(j.Timeline) != 2 || j.Timeline[0].Title != testSong.Title || j.Timeline[1].Title != otherSong.Title {
+		t.Fatalf("unexpected timeline: %+v", j.Timeline)
+	}
+	first, second := j.Timeline[0].Ranges, j.Timeline[1].Ranges
+	if len(first) != 2 || len(second) != 1 {
+		t.Fatalf("expected 2 and 1 ranges, got %+v and %+v", first, second)
+	} else if !(first[0].Start < second[0].Start && second[0].Start < first[1].Start) {
+		t.Fatalf("expected %v to be chopped between %v, got %+v and %+v", otherSong.Title, testSong.Title, second, first)
+	} else if speed := j.Timeline[0].Params.Speed * j.Timeline[0].Params.Tempo; math.Abs(speed-testSpeedup) > 0.02 {
+		t.Fatalf("expected speed %v, got %v", testSpeedup, speed)
+	} else if !j.Sample.Found || j.Sample.Title != testSong.Title {
+		t.Fatalf("expected %v to be chosen, got %+v", testSong.Title, j.Sample)
+	}
+
+	// persistent failures should be reported
+	srv.Fail(100, http.StatusInternalServerError)
+	j = &identifyJob{ID: jobID(path, ""), URI: path}
+	s.doJob(context.Background(), j)
+	if j.Error == "" {
+		t.Fatal("expected error")
+	}
+}
+
+// runModel drives m until it quits, running commands synchronously.
+func runModel(t *testing.T, m tea.Model) tea.Model {
+	t.Helper()
+	cmdType := reflect.TypeOf(tea.Cmd(nil))
+	queue := []tea.Cmd{m.Init()}
+	for len(queue) > 0 {
+		cmd := queue[0]
+		queue = queue[1:]
+		if cmd == nil {
+			continue
+		}
+		switch msg := cmd().(type) {
+		case nil, spinner.TickMsg:
+			// spinners would tick forever
+		case tea.QuitMsg:
+			return m
+		case tea.BatchMsg:
+			queue = append(queue, msg...)
+		default:
+			if v := reflect.ValueOf(msg); v.Kind() == reflect.Slice && v.Type().Elem() == cmdType {
+				// tea.Sequence
+				for i := 0; i < v.Len(); i++ {
+					queue = append(queue, v.Index(i).Interface().(tea.Cmd))
+				}
+				continue
+			}
+			var next tea.Cmd
+			m, next = m.Update(msg)
+			queue = append(queue, next)
+		}
+	}
+	t.Fatal("model did not quit")
+	return nil
+}
+
+func TestSingleModel(t *testing.T) {
+	srv, path := newTestEnv(t, t.TempDir())
+	opts := testOptions(srv)
+	m := runModel(t, newSingleModel(mediaFile{Path: path}, 0, opts)).(*identifySingleModel)
+	if m.err != nil {
+		t.Fatal(m.err)
+	}
+	checkSample(t, m.id)
+	if m.links == nil || m.links.Platforms["YouTube"] != testSong.Links["youtube"] {
+		t.Fatalf("wrong links: %v", m.links)
+	}
+}
+
+func TestAlbumModel(t *testing.T) {
+	dir := t.TempDir()
+	srv, _ := newTestEnv(t, dir)
+	writeWAV(t, filepath.Join(dir, "02 - original.wav"), 16000, shazamtest.Synthesize(2, 16000, 60*time.Second))
+	// a truncated track should fail without affecting the others
+	truncated := filepath.Join(dir, "03 - truncated.wav")
+	writeWAV(t, truncated, 16000, shazamtest.Synthesize(3, 16000, 60*time.Second))
+	if err := os.Truncate(truncated, 16000*20); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "cover.jpg"), []byte("\xff\xd8\xff"), 0644)
+	opts := testOptions(srv)
+	m := runModel(t, newAlbumModel(mediaFile{Path: dir}, opts, 2)).(*identifyAlbumModel)
+	if m.err != nil {
+		t.Fatal(m.err)
+	} else if len(m.tracks) != 3 {
+		t.Fatalf("expected 3 tracks, got %v", len(m.tracks))
+	}
+	checkSample(t, m.tracks[0].id)
+	if m.tracks[1].status != "done" || m.tracks[1].id.sample != nil {
+		t.Fatalf("expected no sample in second track, got %v", m.tracks[1].render())
+	} else if m.tracks[2].status != "failed" || !errors.Is(m.tracks[2].err, errTruncated) {
+		t.Fatalf("expected third track to be truncated, got %v", m.tracks[2].render())
+	}
+}
+
+func TestAlbumModelFailures(t *testing.T) {
+	dir := t.TempDir()
+	srv, path := newTestEnv(t, dir)
+	if err := os.Truncate(path, 16000*20); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "02 - empty.wav"), nil, 0644)
+	// fading out should not fail even though nothing was ever played
+	opts := testOptions(srv)
+	opts.silent = false
+	m := runModel(t, newAlbumModel(mediaFile{Path: dir}, opts, 1)).(*identifyAlbumModel)
+	if m.err != nil {
+		t.Fatal(m.err)
+	}
+	for _, track := range m.tracks {
+		if track.status != "failed" {
+			t.Fatalf("expected track to fail, got %v", track.render())
+		}
+	}
+}
+
+func TestRefinement(t *testing.T) {
+	srv, _ := newTestEnv(t, t.TempDir())
+	// a speed just off the grid; the fake server only matches clips within
+	// about 0.3% of the true speed, so this is as far off as it can be
+	// while still being found by the coarse search
+	const speedup = 1.246
+	path := filepath.Join(t.TempDir(), "sampled.wav")
+	writeWAV(t, path, 16000, resampleLinear(testSource(), 1/speedup))
+	id := identifyTrack(t, testOptions(srv), path)
+	if id.sample == nil {
+		t.Fatal("sample not found")
+	}
+	// the grid's 1.25 is within the fake server's tolerance, so only
+	// refinement can get closer than that
+	if speed := id.sample.params.speed(); math.Abs(speed-speedup) > 0.002 {
+		t.Fatalf("expected refined speed %v, got %v", speedup, speed)
+	} else if id.refinements == 0 || id.refinements > 2 {
+		t.Fatalf("expected 1 or 2 refinements, got %v", id.refinements)
+	}
+}
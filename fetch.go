@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -31,13 +33,100 @@ func execCmd(prog string, args ...string) ([]byte, error) {
 	return stdout.Bytes(), nil
 }
 
-func cmdFetchLinks(appleID string) tea.Cmd {
-	return func() tea.Msg {
-		if appleID == "" {
-			return msgLinks{make(map[string]string)}
+// linkPlatforms are the streaming platforms shown for identified songs, in
+// display order.
+var linkPlatforms = []string{"YouTube", "Spotify", "Apple Music", "Bandcamp"}
+
+// parsePlatforms parses a comma-separated list of platform names.
+func parsePlatforms(s string) []string {
+	var platforms []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			platforms = append(platforms, p)
 		}
-		links, err := shazam.Links(appleID)
-		if err != nil {
+	}
+	return platforms
+}
+
+type platformLink struct {
+	Name string
+	URL  string
+}
+
+// shownLinks returns the links for linkPlatforms, in order.
+func shownLinks(links map[string]string) []platformLink {
+	var shown []platformLink
+	for _, p := range linkPlatforms {
+		for name, url := range links {
+			if strings.EqualFold(name, p) {
+				shown = append(shown, platformLink{name, url})
+				break
+			}
+		}
+	}
+	return shown
+}
+
+// findLinks returns streaming links for res from song.link. If res has no
+// Apple ID, it falls back to finding the song on Deezer by ISRC, then to
+// searching Deezer by artist and title, and finally (unless opts.offline is
+// set) to searching YouTube with yt-dlp; such links are marked as low
+// confidence.
+func findLinks(ctx context.Context, opts searchOptions, res shazam.Result) (shazam.SongLinks, error) {
+	client := opts.links
+	if res.AppleID != "" {
+		return client.Links(ctx, res.AppleID)
+	}
+	if res.ISRC != "" {
+		if links, err := client.LinksByISRC(ctx, res.ISRC); err == nil && len(links.Platforms) > 0 {
+			return links, nil
+		} else if ctx.Err() != nil {
+			return shazam.SongLinks{}, ctx.Err()
+		}
+	}
+	if res.Artist == "" || res.Title == "" {
+		return shazam.SongLinks{}, nil
+	}
+	if links, err := client.SearchLinks(ctx, res.Artist, res.Title); err == nil && len(links.Platforms) > 0 {
+		return links, nil
+	} else if ctx.Err() != nil {
+		return shazam.SongLinks{}, ctx.Err()
+	}
+	if opts.offline {
+		return shazam.SongLinks{}, nil
+	}
+	if url, err := searchYouTube(res.Artist + " - " + res.Title); err == nil && url != "" {
+		return shazam.SongLinks{
+			Platforms:     map[string]string{"YouTube": url},
+			LowConfidence: true,
+		}, nil
+	}
+	return shazam.SongLinks{}, nil
+}
+
+// searchYouTube returns the URL of the top YouTube search result for query.
+func searchYouTube(query string) (string, error) {
+	var res struct {
+		Entries []struct {
+			URL string
+		}
+	}
+	if out, err := execCmd("yt-dlp", "-J", "--flat-playlist", "ytsearch1:"+query); err != nil {
+		return "", err
+	} else if err := json.Unmarshal(out, &res); err != nil {
+		return "", err
+	} else if len(res.Entries) == 0 {
+		return "", nil
+	}
+	return res.Entries[0].URL, nil
+}
+
+func cmdFetchLinks(ctx context.Context, opts searchOptions, res shazam.Result) tea.Cmd {
+	return func() tea.Msg {
+		links, err := findLinks(ctx, opts, res)
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
 			return msgError{err}
 		}
 		return msgLinks{links}
@@ -65,7 +154,9 @@ type mediaYouTube struct {
 	ID       string
 	Title    string
 	Chapters []struct {
-		Title string
+		Title     string
+		StartTime float64 `json:"start_time"`
+		EndTime   float64 `json:"end_time"`
 	}
 }
 
@@ -106,32 +197,62 @@ func resolveURI(uri string) (mediaURI, bool, error) {
 	return ytpl, len(ytpl.Chapters) > 0, nil
 }
 
-func fetchTrack(uri mediaURI, maxSize int64) (string, error) {
+// fetchTrack returns the path of the audio for uri, downloading it if
+// necessary. Downloaded audio is protected from eviction until release is
+// called; release may be called more than once.
+func fetchTrack(uri mediaURI, maxSize int64) (path string, release func(), err error) {
 	switch uri := uri.(type) {
 	case mediaFile:
-		return uri.Path, nil
+		return uri.Path, func() {}, nil
 	case mediaBandcamp:
-		path := os.TempDir() + "/barbershop_bandcamp_" + url.PathEscape(uri.ArtistID+"_"+uri.Slug) + ".wav"
 		url := fmt.Sprintf("https://%v.bandcamp.com/track/%v", uri.ArtistID, uri.Slug)
-		if _, err := os.Stat(path); err == nil {
-			return path, nil
-		} else if _, err := execCmd("yt-dlp", "-x", "--audio-format", "wav", "--max-filesize", fmt.Sprint(maxSize), "-o", path, "--", url); err != nil {
-			return "", err
+		key := downloadKey("bandcamp", uri.ArtistID, uri.Slug)
+		dir, err := downloads.fetch(key, url, uri.Slug, func(dir string) error {
+			_, err := downloadAudio(dir, url, maxSize)
+			return err
+		})
+		if err != nil {
+			return "", nil, err
 		}
-		return path, nil
+		return filepath.Join(dir, "audio.wav"), downloads.releaser(key), nil
 	case mediaYouTube:
-		path := os.TempDir() + "/barbershop_youtube_" + url.PathEscape(uri.Title) + ".wav"
-		if _, err := os.Stat(path); err == nil {
-			return path, nil
-		} else if _, err := execCmd("yt-dlp", "-x", "--audio-format", "wav", "--max-filesize", fmt.Sprint(maxSize), "-o", path, "--", uri.ID); err != nil {
-			return "", err
+		url := "https://www.youtube.com/watch?v=" + uri.ID
+		key := downloadKey("youtube", uri.ID)
+		dir, err := downloads.fetch(key, url, uri.Title, func(dir string) error {
+			_, err := downloadAudio(dir, url, maxSize)
+			return err
+		})
+		if err != nil {
+			return "", nil, err
 		}
-		return path, nil
+		return filepath.Join(dir, "audio.wav"), downloads.releaser(key), nil
 	default:
 		panic(fmt.Sprintf("unhandled mediaURI type: %T", uri))
 	}
 }
 
+// downloadAudio downloads the audio of url to dir in its native compressed
+// format, named audio.original.<ext>, which is used for playback. From it, it
+// derives the 16 kHz mono WAV that is used for identification, named
+// audio.wav. It returns the path of the original.
+func downloadAudio(dir, url string, maxSize int64) (string, error) {
+	if _, err := execCmd("yt-dlp", "-x", "--max-filesize", fmt.Sprint(maxSize), "-o", filepath.Join(dir, "audio.original.%(ext)s"), "--", url); err != nil {
+		return "", err
+	}
+	audio := filepath.Join(dir, "audio.wav")
+	original := playbackPath(audio)
+	if original == audio {
+		return "", errors.New("yt-dlp did not produce an audio file")
+	}
+	_, err := execCmd("ffmpeg", "-v", "error", "-i", original, "-ac", "1", "-ar", "16000", "-c:a", "pcm_s16le", audio)
+	return original, err
+}
+
+// downloadKey joins parts into a downloadCache key.
+func downloadKey(parts ...string) string {
+	return url.PathEscape(strings.Join(parts, "-"))
+}
+
 type playlistEntry struct {
 	Title string
 	URI   mediaURI
@@ -142,7 +263,10 @@ type playlist struct {
 	Entries []playlistEntry
 }
 
-func fetchPlaylist(uri mediaURI) (playlist, error) {
+// fetchPlaylist returns the entries of the album at uri. If the entries had to
+// be downloaded as a whole, e.g. YouTube chapters, they are protected from
+// eviction until release is called; release may be called more than once.
+func fetchPlaylist(uri mediaURI) (pl playlist, release func(), err error) {
 	switch uri := uri.(type) {
 	case mediaFile:
 		pl := playlist{
@@ -150,9 +274,12 @@ func fetchPlaylist(uri mediaURI) (playlist, error) {
 		}
 		files, err := os.ReadDir(uri.Path)
 		if err != nil {
-			return playlist{}, err
+			return playlist{}, nil, err
 		}
 		for _, file := range files {
+			if file.IsDir() || !isAudioFile(file.Name()) {
+				continue // e.g. cover art
+			}
 			pl.Entries = append(pl.Entries, playlistEntry{
 				Title: file.Name(),
 				URI: mediaFile{
@@ -160,7 +287,7 @@ func fetchPlaylist(uri mediaURI) (playlist, error) {
 				},
 			})
 		}
-		return pl, nil
+		return pl, func() {}, nil
 
 	case mediaBandcamp:
 		var bcpl struct {
@@ -173,9 +300,9 @@ func fetchPlaylist(uri mediaURI) (playlist, error) {
 		}
 		url := fmt.Sprintf("https://%v.bandcamp.com/album/%v", uri.ArtistID, uri.Slug)
 		if out, err := execCmd("yt-dlp", "-J", "--flat-playlist", url); err != nil {
-			return playlist{}, err
+			return playlist{}, nil, err
 		} else if err := json.Unmarshal(out, &bcpl); err != nil {
-			return playlist{}, err
+			return playlist{}, nil, err
 		}
 		pl := playlist{
 			Title:   bcpl.ArtistID + " - " + bcpl.Title, // TODO: fetch a nicer artist name
@@ -189,31 +316,50 @@ func fetchPlaylist(uri mediaURI) (playlist, error) {
 				Slug:     slug,
 			}
 		}
-		return pl, nil
+		return pl, func() {}, nil
 
 	case mediaYouTube:
 		pl := playlist{
 			Title:   uri.Title,
 			Entries: make([]playlistEntry, len(uri.Chapters)),
 		}
-		dst := os.TempDir() + "/barbershop_youtube_" + uri.ID
+		chapterName := func(i int) string {
+			return fmt.Sprintf("%03d %v", i+1, strings.ReplaceAll(uri.Chapters[i].Title, "/", "_"))
+		}
+		url := "https://www.youtube.com/watch?v=" + uri.ID
+		key := downloadKey("youtube", uri.ID, "chapters")
+		dst, err := downloads.fetch(key, url, uri.Title, func(dir string) error {
+			original, err := downloadAudio(dir, url, 10e9)
+			if err != nil {
+				return err
+			}
+			// split both files without re-encoding, rather than having yt-dlp
+			// split (and re-encode) the original
+			audio := filepath.Join(dir, "audio.wav")
+			for i, c := range uri.Chapters {
+				name := filepath.Join(dir, chapterName(i))
+				for _, f := range [][2]string{
+					{audio, name + ".wav"},
+					{original, name + ".original" + filepath.Ext(original)},
+				} {
+					if _, err := execCmd("ffmpeg", "-v", "error", "-i", f[0], "-ss", fmt.Sprint(c.StartTime), "-to", fmt.Sprint(c.EndTime), "-c", "copy", f[1]); err != nil {
+						return err
+					}
+				}
+			}
+			os.Remove(original)
+			return os.Remove(audio)
+		})
+		if err != nil {
+			return playlist{}, nil, err
+		}
 		for i := range pl.Entries {
 			pl.Entries[i].Title = uri.Chapters[i].Title
 			pl.Entries[i].URI = mediaFile{
-				Path: fmt.Sprintf("%v/%v - %03d %v [%v].wav", dst, pl.Title, i+1, uri.Chapters[i].Title, uri.ID),
-			}
-		}
-		// download, if we haven't already necessary
-		for _, e := range pl.Entries {
-			if _, err := os.Stat(e.URI.(mediaFile).Path); err != nil {
-				dst := os.TempDir() + "/barbershop_youtube_" + uri.ID
-				if _, err := execCmd("yt-dlp", "-x", "--audio-format", "wav", "--split-chapters", "-P", dst, uri.ID); err != nil {
-					return playlist{}, err
-				}
-				break
+				Path: filepath.Join(dst, chapterName(i)+".wav"),
 			}
 		}
-		return pl, nil
+		return pl, downloads.releaser(key), nil
 
 	default:
 		panic(fmt.Sprintf("unhandled mediaURI type: %T", uri))
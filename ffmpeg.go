@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/faiface/beep"
+)
+
+// Container formats recognized by sniffFormat.
+const (
+	formatUnknown = ""
+	formatWAV     = "wav"
+	formatMP3     = "mp3"
+	formatVorbis  = "vorbis"
+	formatOpus    = "opus"
+	formatFLAC    = "flac"
+	formatMP4     = "mp4" // AAC or ALAC, usually .m4a
+	formatAAC     = "aac" // raw ADTS
+	formatWebM    = "webm"
+)
+
+// sniffFormat identifies the container format of a file from its first few
+// bytes.
+func sniffFormat(hdr []byte) string {
+	switch {
+	case len(hdr) >= 12 && string(hdr[:4]) == "RIFF" && string(hdr[8:12]) == "WAVE":
+		return formatWAV
+	case bytes.HasPrefix(hdr, []byte("fLaC")):
+		return formatFLAC
+	case bytes.HasPrefix(hdr, []byte("OggS")):
+		// the codec is identified by the first packet
+		if bytes.Contains(hdr[:min(len(hdr), 64)], []byte("OpusHead")) {
+			return formatOpus
+		} else if bytes.Contains(hdr[:min(len(hdr), 64)], []byte("\x01vorbis")) {
+			return formatVorbis
+		}
+		return formatUnknown
+	case len(hdr) >= 8 && string(hdr[4:8]) == "ftyp":
+		return formatMP4
+	case bytes.HasPrefix(hdr, []byte("\x1a\x45\xdf\xa3")):
+		return formatWebM
+	case bytes.HasPrefix(hdr, []byte("ID3")):
+		return formatMP3
+	case len(hdr) >= 2 && hdr[0] == 0xFF && hdr[1]&0xF6 == 0xF0:
+		return formatAAC
+	case len(hdr) >= 2 && hdr[0] == 0xFF && hdr[1]&0xE0 == 0xE0:
+		return formatMP3
+	}
+	return formatUnknown
+}
+
+// An ffmpegStreamer decodes audio by piping it through ffmpeg, for formats
+// that beep can't decode natively. Seeking restarts ffmpeg at the new
+// position.
+type ffmpegStreamer struct {
+	path   string
+	format beep.Format
+	len    int
+	pos    int
+	err    error
+
+	cmd    *exec.Cmd
+	out    *bufio.Reader
+	stderr bytes.Buffer
+	done   bool // ffmpeg has exited
+	buf    []byte
+}
+
+func (s *ffmpegStreamer) start() error {
+	s.cmd = exec.Command("ffmpeg", "-v", "error",
+		"-ss", strconv.FormatFloat(s.format.SampleRate.D(s.pos).Seconds(), 'f', -1, 64),
+		"-i", s.path,
+		"-vn", "-f", "f32le", "-ac", "2", "-ar", fmt.Sprint(int(s.format.SampleRate)), "-")
+	s.stderr.Reset()
+	s.cmd.Stderr = &s.stderr
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return err
+	} else if err := s.cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return errors.New("ffmpeg not found")
+		}
+		return err
+	}
+	s.out = bufio.NewReaderSize(stdout, 1<<16)
+	return nil
+}
+
+func (s *ffmpegStreamer) stop() {
+	if s.cmd != nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+	}
+	s.cmd, s.out = nil, nil
+}
+
+// Stream implements beep.Streamer.
+func (s *ffmpegStreamer) Stream(samples [][2]float64) (n int, ok bool) {
+	if s.err != nil || s.done {
+		return 0, false
+	} else if s.out == nil {
+		if s.err = s.start(); s.err != nil {
+			return 0, false
+		}
+	}
+	if need := len(samples) * 8; len(s.buf) < need {
+		s.buf = make([]byte, need)
+	}
+	read, err := io.ReadFull(s.out, s.buf[:len(samples)*8])
+	n = read / 8
+	for i := range samples[:n] {
+		samples[i][0] = float64(math.Float32frombits(binary.LittleEndian.Uint32(s.buf[i*8:])))
+		samples[i][1] = float64(math.Float32frombits(binary.LittleEndian.Uint32(s.buf[i*8+4:])))
+	}
+	s.pos += n
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if err := s.cmd.Wait(); err != nil {
+			s.err = fmt.Errorf("ffmpeg: %v", strings.TrimSpace(s.stderr.String()))
+		}
+		s.cmd, s.done = nil, true
+	} else if err != nil {
+		s.err = err
+	}
+	return n, n > 0
+}
+
+// Err implements beep.Streamer.
+func (s *ffmpegStreamer) Err() error {
+	return s.err
+}
+
+// Len implements beep.StreamSeeker. It is derived from the duration reported
+// by ffprobe, and may be slightly inaccurate.
+func (s *ffmpegStreamer) Len() int {
+	return s.len
+}
+
+// Position implements beep.StreamSeeker.
+func (s *ffmpegStreamer) Position() int {
+	return s.pos
+}
+
+// Seek implements beep.StreamSeeker.
+func (s *ffmpegStreamer) Seek(p int) error {
+	if p < 0 || p > s.len {
+		return fmt.Errorf("seek position %v out of range [0, %v]", p, s.len)
+	}
+	s.stop()
+	s.pos, s.done = p, false
+	return nil
+}
+
+// Close implements beep.StreamSeekCloser.
+func (s *ffmpegStreamer) Close() error {
+	s.stop()
+	return nil
+}
+
+// decodeFFmpeg returns a streamer that decodes the file at path with ffmpeg.
+func decodeFFmpeg(path string) (*ffmpegStreamer, beep.Format, error) {
+	out, err := execCmd("ffprobe", "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "stream=sample_rate:format=duration", "-of", "json", path)
+	if err != nil {
+		return nil, beep.Format{}, err
+	}
+	var probe struct {
+		Streams []struct {
+			SampleRate string `json:"sample_rate"`
+		}
+		Format struct {
+			Duration string
+		}
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, beep.Format{}, err
+	} else if len(probe.Streams) == 0 {
+		return nil, beep.Format{}, fmt.Errorf("no audio stream in %v", path)
+	}
+	sampleRate, err := strconv.Atoi(probe.Streams[0].SampleRate)
+	if err != nil {
+		return nil, beep.Format{}, fmt.Errorf("invalid sample rate %q", probe.Streams[0].SampleRate)
+	}
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil {
+		return nil, beep.Format{}, fmt.Errorf("invalid duration %q", probe.Format.Duration)
+	}
+	format := beep.Format{
+		SampleRate:  beep.SampleRate(sampleRate),
+		NumChannels: 2,
+		Precision:   4,
+	}
+	return &ffmpegStreamer{
+		path:   path,
+		format: format,
+		len:    int(duration * float64(sampleRate)),
+	}, format, nil
+}
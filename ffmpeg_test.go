@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/faiface/beep"
+)
+
+func TestSniffFormat(t *testing.T) {
+	tests := []struct {
+		hdr    string
+		format string
+	}{
+		{"RIFF\x24\x00\x00\x00WAVEfmt ", formatWAV},
+		{"ID3\x04\x00\x00", formatMP3},
+		{"\xff\xfb\x90\x64", formatMP3},
+		{"\xff\xf1\x50\x80", formatAAC},
+		{"fLaC\x00\x00\x00\x22", formatFLAC},
+		{"\x00\x00\x00\x20ftypM4A ", formatMP4},
+		{"OggS\x00\x02" + string(make([]byte, 22)) + "OpusHead", formatOpus},
+		{"OggS\x00\x02" + string(make([]byte, 22)) + "\x01vorbis", formatVorbis},
+		{"\x1a\x45\xdf\xa3\x9f\x42\x86\x81", formatWebM},
+		{"\x89PNG\r\n\x1a\n", formatUnknown},
+		{"", formatUnknown},
+	}
+	for _, test := range tests {
+		if got := sniffFormat([]byte(test.hdr)); got != test.format {
+			t.Errorf("sniffFormat(%q) = %q, want %q", test.hdr, got, test.format)
+		}
+	}
+}
+
+func TestFFmpegStreamer(t *testing.T) {
+	for _, prog := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(prog); err != nil {
+			t.Skip(prog, "not found")
+		}
+	}
+	// a sawtooth, so that the position of each sample within a period can be
+	// recovered from its value
+	const sampleRate, period = 16000, 1000
+	src := make([]float64, 3*sampleRate)
+	for i := range src {
+		src[i] = -0.9 + 1.8*float64(i%period)/period
+	}
+	dir := t.TempDir()
+	wavPath, flacPath := filepath.Join(dir, "src.wav"), filepath.Join(dir, "src.flac")
+	writeWAV(t, wavPath, sampleRate, src)
+	if _, err := execCmd("ffmpeg", "-v", "error", "-i", wavPath, flacPath); err != nil {
+		t.Fatal(err)
+	}
+
+	s, format, err := decodeFFmpeg(flacPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if format.SampleRate != sampleRate {
+		t.Fatalf("expected sample rate %v, got %v", sampleRate, format.SampleRate)
+	} else if d := s.Len() - len(src); d < -sampleRate/10 || d > sampleRate/10 {
+		t.Fatalf("expected length %v, got %v", len(src), s.Len())
+	}
+	// checkPos checks that samples begin at position pos of src.
+	checkPos := func(samples [][2]float64, pos int) {
+		t.Helper()
+		got := int(math.Round((samples[0][0] + 0.9) / 1.8 * period))
+		if d := (got - pos%period + period) % period; d > 2 && d < period-2 {
+			t.Fatalf("expected position %v, got %v (mod %v)", pos, got, period)
+		} else if samples[0][0] != samples[0][1] {
+			t.Fatalf("expected mono audio in both channels, got %v", samples[0])
+		}
+	}
+
+	// stream the whole file
+	buf := make([][2]float64, 4096)
+	var total int
+	for {
+		n, ok := s.Stream(buf)
+		if n > 0 {
+			checkPos(buf[:n], total)
+		}
+		total += n
+		if !ok {
+			break
+		}
+	}
+	if s.Err() != nil {
+		t.Fatal(s.Err())
+	} else if total != len(src) || s.Position() != total {
+		t.Fatalf("expected %v samples, got %v (position %v)", len(src), total, s.Position())
+	} else if n, ok := s.Stream(buf); n != 0 || ok {
+		t.Fatal("expected stream to stay exhausted")
+	}
+
+	// seeking should restart ffmpeg, even after the stream is exhausted
+	for _, pos := range []int{sampleRate + 123, 0, 2*sampleRate + 457} {
+		if err := s.Seek(pos); err != nil {
+			t.Fatal(err)
+		} else if n, ok := s.Stream(buf[:100]); n != 100 || !ok {
+			t.Fatalf("expected 100 samples after seeking to %v, got %v", pos, n)
+		}
+		checkPos(buf, pos)
+		if s.Position() != pos+100 {
+			t.Fatalf("expected position %v, got %v", pos+100, s.Position())
+		}
+	}
+	if err := s.Seek(s.Len() + 1); err == nil {
+		t.Fatal("expected out-of-range seek to fail")
+	}
+
+	// ffmpeg's error output should be reported
+	if err := s.Seek(0); err != nil {
+		t.Fatal(err)
+	} else if err := os.Remove(flacPath); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := s.Stream(buf); n != 0 || ok {
+		t.Fatal("expected stream to fail")
+	} else if err := s.Err(); err == nil || !strings.HasPrefix(err.Error(), "ffmpeg: ") {
+		t.Fatalf("expected ffmpeg error, got %v", err)
+	}
+}
+
+// overlongStreamer reports a length longer than the audio it streams, like an
+// ffmpegStreamer whose duration estimate is too high.
+type overlongStreamer struct {
+	beep.StreamSeekCloser
+	extra int
+}
+
+func (s overlongStreamer) Len() int {
+	return s.StreamSeekCloser.Len() + s.extra
+}
+
+func TestCheckedStreamerSlack(t *testing.T) {
+	format := beep.Format{SampleRate: 1000, NumChannels: 1, Precision: 2}
+	audio, _ := decodeStream(format, beep.Silence(60000))
+	tests := []struct {
+		extra, slack int
+		truncated    bool
+	}{
+		{500, 1000, false},
+		{2000, 1000, true},
+		{2000, 3000, false}, // slightly inaccurate estimate
+		{30000, 4500, true}, // truncated file with an estimated length
+	}
+	for _, test := range tests {
+		s := &checkedStreamer{overlongStreamer{audio.cursor(), test.extra}, "test.flac", format, test.slack, nil}
+		buf := make([][2]float64, 512)
+		for {
+			if _, ok := s.Stream(buf); !ok {
+				break
+			}
+		}
+		if truncated := errors.Is(s.Err(), errTruncated); truncated != test.truncated {
+			t.Errorf("extra = %v, slack = %v: unexpected error %v", test.extra, test.slack, s.Err())
+		}
+	}
+}
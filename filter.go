@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A filterChain is a set of preprocessing stages applied to a clip before it
+// is fingerprinted, to strip away the layers that a producer has added on top
+// of the sample.
+type filterChain uint8
+
+// Preprocessing stages, applied in this order.
+const (
+	// filterBandPass removes rumble and hiss outside the range that Shazam
+	// fingerprints, and gently boosts the midrange where melodies sit
+	filterBandPass filterChain = 1 << iota
+	// filterDrums suppresses percussive transients, such as added drums
+	filterDrums
+	// filterDenoise gates steady background noise, such as vinyl crackle or
+	// rain
+	filterDenoise
+
+	// filterDrumsRemoved is the full chain, used to retry clips that failed
+	// to match
+	filterDrumsRemoved = filterBandPass | filterDrums | filterDenoise
+)
+
+var filterNames = []struct {
+	f    filterChain
+	name string
+}{
+	{filterBandPass, "bandpass"},
+	{filterDrums, "drums"},
+	{filterDenoise, "denoise"},
+}
+
+// String returns the comma-separated names of the stages in c.
+func (c filterChain) String() string {
+	var names []string
+	for _, fn := range filterNames {
+		if c&fn.f != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// parseFilterChain parses a comma-separated list of stage names. "all" selects
+// every stage, and "" or "none" selects none.
+func parseFilterChain(s string) (filterChain, error) {
+	var c filterChain
+	for _, name := range strings.Split(s, ",") {
+		switch name = strings.TrimSpace(strings.ToLower(name)); name {
+		case "", "none":
+			continue
+		case "all":
+			c |= filterDrumsRemoved
+			continue
+		}
+		found := false
+		for _, fn := range filterNames {
+			if fn.name == name {
+				c |= fn.f
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown filter %q", name)
+		}
+	}
+	return c, nil
+}
+
+// apply runs the stages of c over x, which is sampled at sampleRate.
+func (c filterChain) apply(x []float64, sampleRate int) []float64 {
+	if c&filterBandPass != 0 {
+		x = highPass(120, 0.707, sampleRate).apply(x)
+		x = lowPass(min(5500, 0.45*float64(sampleRate)), 0.707, sampleRate).apply(x)
+		x = peakingEQ(1500, 1, 3, sampleRate).apply(x)
+	}
+	if c&filterDrums != 0 {
+		x = suppressPercussion(x)
+	}
+	if c&filterDenoise != 0 {
+		x = spectralGate(x)
+	}
+	return x
+}
+
+// A clipEffect undoes an effect that may have been applied to the sample as a
+// whole, such as playing it backwards. Unlike a filterChain, effects are tried
+// as a separate search dimension once the regular transforms have failed.
+type clipEffect uint8
+
+// Clip effects, applied in this order.
+const (
+	// effectReverse plays the clip backwards
+	effectReverse clipEffect = 1 << iota
+	// effectUnfilter restores the high frequencies of a heavily low-passed
+	// sample
+	effectUnfilter
+	// effectHighShelf boosts the treble of a muffled sample
+	effectHighShelf
+)
+
+var effectNames = []struct {
+	e    clipEffect
+	name string
+}{
+	{effectReverse, "reversed"},
+	{effectUnfilter, "low-pass removed"},
+	{effectHighShelf, "high-shelf boosted"},
+}
+
+// String returns the comma-separated names of the effects in e.
+func (e clipEffect) String() string {
+	var names []string
+	for _, en := range effectNames {
+		if e&en.e != 0 {
+			names = append(names, en.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// apply applies the effects of e to x, which is sampled at sampleRate.
+func (e clipEffect) apply(x []float64, sampleRate int) []float64 {
+	if e&effectReverse != 0 {
+		r := make([]float64, len(x))
+		for i, s := range x {
+			r[len(x)-1-i] = s
+		}
+		x = r
+	}
+	if e&effectUnfilter != 0 {
+		x = removeLowPass(x, sampleRate)
+	}
+	if e&effectHighShelf != 0 {
+		x = highShelf(1500, 12, sampleRate).apply(x)
+	}
+	return x
+}
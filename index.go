@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lukechampine.com/barbershop/shazam"
+)
+
+// maxIndexWorkers caps the number of files indexed concurrently. Each worker
+// holds an entire decoded track in memory, so this is kept well below the CPU
+// count on large machines.
+const maxIndexWorkers = 4
+
+var audioExts = map[string]bool{
+	".wav":  true,
+	".mp3":  true,
+	".ogg":  true,
+	".opus": true,
+	".flac": true,
+	".m4a":  true,
+	".mp4":  true,
+	".aac":  true,
+	".webm": true,
+}
+
+func isAudioFile(path string) bool {
+	return audioExts[strings.ToLower(filepath.Ext(path))]
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// trackTags returns the artist, title, and album of the file at path, reading
+// them from the file's tags if possible, and falling back to parsing the
+// filename.
+func trackTags(path string) (artist, title, album string) {
+	var probe struct {
+		Format struct {
+			Tags map[string]string
+		}
+	}
+	if out, err := execCmd("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", path); err == nil && json.Unmarshal(out, &probe) == nil {
+		for k, v := range probe.Format.Tags {
+			switch strings.ToLower(k) {
+			case "artist":
+				artist = v
+			case "title":
+				title = v
+			case "album":
+				album = v
+			}
+		}
+	}
+	if artist == "" || title == "" {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if a, t, ok := strings.Cut(name, " - "); ok {
+			artist, title = strings.TrimSpace(a), strings.TrimSpace(t)
+		} else {
+			title = name
+		}
+	}
+	return
+}
+
+func loadOrCreateIndex(path string) (*shazam.Index, error) {
+	idx, err := shazam.LoadIndex(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return shazam.NewIndex(16000), nil
+	}
+	return idx, err
+}
+
+// indexSource is a file to be added to the index.
+type indexSource struct {
+	path  string
+	title string // overrides the file's tags, if set
+}
+
+// collectIndexSources resolves uri into a list of audio files, downloading
+// them if necessary. Downloaded files are protected from eviction until
+// release is called.
+func collectIndexSources(uri string) (srcs []indexSource, release func(), err error) {
+	u, isAlbum, err := resolveURI(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f, ok := u.(mediaFile); ok {
+		if !isAlbum {
+			return []indexSource{{path: f.Path}}, func() {}, nil
+		}
+		err := filepath.WalkDir(f.Path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			} else if d.Type().IsRegular() && isAudioFile(path) {
+				srcs = append(srcs, indexSource{path: path})
+			}
+			return nil
+		})
+		return srcs, func() {}, err
+	} else if !isAlbum {
+		path, release, err := fetchTrack(u, 10e9)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []indexSource{{path: path}}, release, nil
+	}
+	pl, releasePlaylist, err := fetchPlaylist(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	releases := []func(){releasePlaylist}
+	release = func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, e := range pl.Entries {
+		path, releaseTrack, err := fetchTrack(e.URI, 10e9)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		releases = append(releases, releaseTrack)
+		srcs = append(srcs, indexSource{path: path, title: e.Title})
+	}
+	return srcs, release, nil
+}
+
+// indexFiles computes signatures for each source not already present in the
+// index, saving the index to disk periodically. Files whose path, size, and
+// modification time are unchanged are skipped without being read, files whose
+// contents are already indexed are recorded as aliases of the existing track,
+// and files whose contents have changed replace their previous entry.
+func indexFiles(idx *shazam.Index, indexPath string, srcs []indexSource) error {
+	type indexed struct {
+		src   indexSource
+		file  shazam.IndexedFile
+		id    string // ID of the file's contents, if already indexed
+		track shazam.IndexedTrack
+		sig   shazam.Signature
+		stale string // ID of the previous entry for the same path
+		err   error
+	}
+	type knownFile struct {
+		id string
+		shazam.IndexedFile
+	}
+	byPath := make(map[string]knownFile)
+	for _, t := range idx.Tracks() {
+		for _, f := range idx.Files(t.ID) {
+			byPath[f.Path] = knownFile{t.ID, f}
+		}
+	}
+	index := func(src indexSource) (r indexed) {
+		r.src = src
+		abs, _ := filepath.Abs(src.path)
+		prev, hasPrev := byPath[abs]
+		stat, err := os.Stat(src.path)
+		if err != nil {
+			r.err = err
+			return
+		} else if hasPrev && prev.Size == stat.Size() && prev.ModTime.Equal(stat.ModTime()) {
+			return // unchanged
+		}
+		id, err := hashFile(src.path)
+		if err != nil {
+			r.err = err
+			return
+		}
+		r.file = shazam.IndexedFile{Path: abs, Size: stat.Size(), ModTime: stat.ModTime()}
+		if hasPrev && prev.id != id {
+			r.stale = prev.id
+		}
+		if _, ok := idx.Track(id); ok {
+			r.id = id // touched, or indexed under another path
+			return
+		}
+		sample, err := streamSample(src.path, 1, 0, -1)
+		if err != nil {
+			r.err = err
+			return
+		}
+		r.track = shazam.IndexedTrack{
+			ID:       id,
+			Path:     abs,
+			Duration: time.Duration(len(sample)) * time.Second / 16000,
+			Size:     stat.Size(),
+			ModTime:  stat.ModTime(),
+		}
+		r.track.Artist, r.track.Title, r.track.Album = trackTags(src.path)
+		if src.title != "" {
+			r.track.Title = src.title
+		}
+		r.sig = shazam.ComputeSignature(16000, sample)
+		return
+	}
+	srcChan := make(chan indexSource)
+	resChan := make(chan indexed)
+	var wg sync.WaitGroup
+	for i := 0; i < min(runtime.NumCPU(), maxIndexWorkers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for src := range srcChan {
+				resChan <- index(src)
+			}
+		}()
+	}
+	go func() {
+		for _, src := range srcs {
+			srcChan <- src
+		}
+		close(srcChan)
+		wg.Wait()
+		close(resChan)
+	}()
+
+	var added, skipped, failed int
+	for r := range resChan {
+		if r.stale != "" {
+			idx.RemoveFile(r.stale, r.file.Path)
+		}
+		switch {
+		case r.err != nil:
+			failed++
+			fmt.Printf("Error: %v: %v\n", r.src.path, r.err)
+		case r.track.Path == "":
+			if r.id != "" {
+				idx.AddFile(r.id, r.file)
+			}
+			skipped++
+		case idx.AddFile(r.track.ID, r.file):
+			// another worker indexed the same contents first
+			skipped++
+		default:
+			if err := idx.Add(r.track, r.sig); err != nil {
+				return err
+			}
+			added++
+			fmt.Printf("Indexed %v - %v\n", r.track.Artist, r.track.Title)
+			if added%100 == 0 {
+				if err := idx.Save(indexPath); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	fmt.Printf("Added %v tracks (%v unchanged, %v failed)\n", added, skipped, failed)
+	return idx.Save(indexPath)
+}
+
+// removeFromIndex removes tracks from the index by ID or path. If a directory
+// path is provided, all tracks within it are removed. Tracks that have other
+// source files outside of the given paths are kept under those files.
+func removeFromIndex(idx *shazam.Index, targets []string) (removed []shazam.IndexedTrack) {
+	for _, target := range targets {
+		if t, ok := idx.Track(target); ok {
+			idx.Remove(t.ID)
+			removed = append(removed, t)
+			continue
+		}
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			continue
+		}
+		for _, t := range idx.Tracks() {
+			for _, f := range idx.Files(t.ID) {
+				if f.Path == abs || strings.HasPrefix(f.Path, abs+string(filepath.Separator)) {
+					idx.RemoveFile(t.ID, f.Path)
+				}
+			}
+			if _, ok := idx.Track(t.ID); !ok {
+				removed = append(removed, t)
+			}
+		}
+	}
+	return removed
+}
+
+func renderDuration(d time.Duration) string {
+	if d >= time.Hour {
+		return strconv.Itoa(int(d.Hours())) + ":" + renderTime(d%time.Hour)
+	}
+	return renderTime(d)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lukechampine.com/barbershop/shazam"
+	"lukechampine.com/barbershop/shazam/shazamtest"
+)
+
+func TestIndexFilesDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	indexPath := filepath.Join(dir, "index.gob")
+	a, b := filepath.Join(dir, "a.wav"), filepath.Join(dir, "b.wav")
+	writeWAV(t, a, 16000, shazamtest.Synthesize(1, 16000, 20*time.Second))
+	writeWAV(t, b, 16000, shazamtest.Synthesize(1, 16000, 20*time.Second))
+	srcs := []indexSource{{path: a}, {path: b}}
+
+	// identical files should be recorded under a single track
+	idx := shazam.NewIndex(16000)
+	if err := indexFiles(idx, indexPath, srcs); err != nil {
+		t.Fatal(err)
+	}
+	tracks := idx.Tracks()
+	if len(tracks) != 1 || len(idx.Files(tracks[0].ID)) != 2 {
+		t.Fatalf("expected 1 track with 2 files, got %+v", tracks)
+	}
+	id := tracks[0].ID
+
+	// re-indexing should keep both files
+	if err := indexFiles(idx, indexPath, srcs); err != nil {
+		t.Fatal(err)
+	} else if len(idx.Tracks()) != 1 || len(idx.Files(id)) != 2 {
+		t.Fatalf("expected 1 track with 2 files, got %+v", idx.Files(id))
+	}
+
+	// changing the primary file should leave the track under its alias
+	writeWAV(t, a, 16000, shazamtest.Synthesize(2, 16000, 20*time.Second))
+	if err := indexFiles(idx, indexPath, srcs); err != nil {
+		t.Fatal(err)
+	}
+	if t1, ok := idx.Track(id); !ok || len(idx.Files(id)) != 1 || t1.Path != b {
+		t.Fatalf("expected original track to remain under %v, got %+v", b, t1)
+	} else if tracks := idx.Tracks(); len(tracks) != 2 {
+		t.Fatalf("expected 2 tracks, got %v", len(tracks))
+	}
+}
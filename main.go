@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/time/rate"
+	"lukechampine.com/barbershop/shazam"
 	"lukechampine.com/flagg"
 )
 
@@ -15,6 +23,9 @@ var (
 
 Actions:
     id            identify a sample
+    index         manage the local fingerprint index
+    cache         manage the identification result cache
+    sig           compute, inspect, and submit audio signatures
     serve         run as a service
 `
 	versionUsage = rootUsage
@@ -23,6 +34,93 @@ Actions:
 
 Attempts to identify the original track(s) sampled in the provided URI,
 which must be a filepath or a URL.
+`
+	indexUsage = `Usage:
+    barbershop index [action]
+
+Manages the local fingerprint index used by the "local" backend.
+
+Actions:
+    add           add tracks to the index
+    list          list indexed tracks
+    remove        remove tracks from the index
+    stats         print index statistics
+`
+	indexAddUsage = `Usage:
+    barbershop index add [flags] [uri...]
+
+Computes fingerprints for the provided URIs and adds them to the index. URIs
+may be files, directories (which are searched recursively), or URLs. Files that
+have already been indexed are skipped.
+`
+	indexListUsage = `Usage:
+    barbershop index list [flags]
+
+Lists the tracks in the index.
+`
+	indexRemoveUsage = `Usage:
+    barbershop index remove [flags] [id|path...]
+
+Removes tracks from the index, by ID or by path. If a directory is provided,
+all tracks within it are removed.
+`
+	indexStatsUsage = `Usage:
+    barbershop index stats [flags]
+
+Prints statistics about the index.
+`
+	cacheUsage = `Usage:
+    barbershop cache [action]
+
+Manages the on-disk cache of identification results, which lets 'barbershop
+id' and 'barbershop serve' skip clips that have already been identified.
+
+Actions:
+    stats         print cache statistics
+    prune         remove expired entries and enforce the size limit
+    clear         remove all entries
+`
+	cacheStatsUsage = `Usage:
+    barbershop cache stats [flags]
+
+Prints statistics about the cache.
+`
+	cachePruneUsage = `Usage:
+    barbershop cache prune [flags]
+
+Removes entries older than --cache-ttl, then the oldest entries in excess of
+--cache-max.
+`
+	cacheClearUsage = `Usage:
+    barbershop cache clear [flags]
+
+Removes all entries from the cache.
+`
+	sigUsage = `Usage:
+    barbershop sig [action]
+
+Computes, inspects, and submits audio signatures.
+
+Actions:
+    compute       compute the signature of a clip
+    inspect       print the contents of a signature
+    submit        submit a signature to the identification backend
+`
+	sigComputeUsage = `Usage:
+    barbershop sig compute [flags] [uri]
+
+Computes the signature of a clip of the provided URI, exactly as 'barbershop id'
+would. The signature is written to the --out file, or printed to stdout.
+`
+	sigInspectUsage = `Usage:
+    barbershop sig inspect [flags] [file|data-uri]
+
+Prints the header and per-band peak counts of a signature.
+`
+	sigSubmitUsage = `Usage:
+    barbershop sig submit [flags] [file|data-uri]
+
+Submits a signature to the identification backend and prints the result.
 `
 )
 
@@ -32,21 +130,143 @@ func main() {
 	rootCmd.Usage = flagg.SimpleUsage(rootCmd, rootUsage)
 	versionCmd := flagg.New("version", versionUsage)
 	idCmd := flagg.New("id", idUsage)
-	idCmd.BoolVar(&bb.silent, "silent", false, "don't play audio")
+	silent := idCmd.Bool("silent", false, "don't play audio")
 	track := idCmd.Int("track", 0, "identify the n-th track of the album")
 	manual := idCmd.Bool("manual", false, "control speed and sample offset manually")
+	idSearch := idCmd.String("search", "adaptive", "search strategy (grid, adaptive)")
+	idTimeline := idCmd.Bool("timeline", false, "scan the whole track for multiple samples")
+	idJobs := idCmd.Int("jobs", 1, "number of album tracks to identify concurrently")
 	srvCmd := flagg.New("serve", "run as a service")
 	srvAddr := srvCmd.String("addr", ":8070", "address to serve on")
+	srvSearch := srvCmd.String("search", "adaptive", "search strategy (grid, adaptive)")
+	srvJobs := srvCmd.Int("jobs", 1, "number of jobs to run concurrently")
+	indexCmd := flagg.New("index", indexUsage)
+	indexAddCmd := flagg.New("add", indexAddUsage)
+	indexListCmd := flagg.New("list", indexListUsage)
+	indexRemoveCmd := flagg.New("remove", indexRemoveUsage)
+	indexStatsCmd := flagg.New("stats", indexStatsUsage)
+	cacheCmd := flagg.New("cache", cacheUsage)
+	cacheStatsCmd := flagg.New("stats", cacheStatsUsage)
+	cachePruneCmd := flagg.New("prune", cachePruneUsage)
+	cacheClearCmd := flagg.New("clear", cacheClearUsage)
+	sigCmd := flagg.New("sig", sigUsage)
+	sigComputeCmd := flagg.New("compute", sigComputeUsage)
+	sigSpeed := sigComputeCmd.Float64("speed", 1, "playback speed")
+	sigTempo := sigComputeCmd.Float64("tempo", 1, "pitch-preserving speedup")
+	sigPitch := sigComputeCmd.Float64("pitch", 0, "tempo-preserving pitch shift, in semitones")
+	sigFilter := sigComputeCmd.String("filter", "none", "preprocessing to apply (bandpass, drums, denoise, all, none; comma-separated)")
+	sigOffset := sigComputeCmd.Duration("offset", 24*time.Second, "clip offset, after applying speed")
+	sigDuration := sigComputeCmd.Duration("duration", 12*time.Second, "clip duration")
+	sigOut := sigComputeCmd.String("out", "", "write signature to file")
+	sigFormat := sigComputeCmd.String("format", "", "output format (sig, base64, json); defaults to sig for files and base64 for stdout")
+	sigInspectCmd := flagg.New("inspect", sigInspectUsage)
+	sigInspectJSON := sigInspectCmd.Bool("json", false, "dump all peaks as JSON")
+	sigSubmitCmd := flagg.New("submit", sigSubmitUsage)
+	var idCfg identifierConfig
+	var reqRate float64
+	for _, cmd := range []*flag.FlagSet{idCmd, srvCmd, sigSubmitCmd} {
+		cmd.StringVar(&idCfg.backend, "backend", "shazam", "identification backend ("+backendNames()+")")
+		cmd.Float64Var(&reqRate, "rate", 20, "maximum backend requests per minute, shared by all tracks")
+	}
+	var parallel int
+	var retryFilter string
+	var recordDir, replayDir string
+	platforms := strings.Join(linkPlatforms, ",")
+	var decodedMax int64
+	for _, cmd := range []*flag.FlagSet{idCmd, srvCmd} {
+		cmd.StringVar(&platforms, "platforms", platforms, "comma-separated streaming platforms to show links for")
+		cmd.Int64Var(&decodedMax, "decoded-max", maxDecodedSize>>20, "maximum size of decoded audio kept in memory, in MiB")
+		cmd.IntVar(&parallel, "parallel", 3, "number of requests in flight per track")
+		cmd.StringVar(&retryFilter, "filter", "none", "preprocessing to retry unmatched clips with (bandpass, drums, denoise, all, none; comma-separated)")
+		cmd.StringVar(&recordDir, "record", "", "record API responses to this directory")
+		cmd.StringVar(&replayDir, "replay", "", "replay API responses recorded in this directory, without network access")
+	}
+	for _, cmd := range []*flag.FlagSet{idCmd, srvCmd, sigSubmitCmd, indexAddCmd, indexListCmd, indexRemoveCmd, indexStatsCmd} {
+		cmd.StringVar(&idCfg.indexPath, "index", defaultIndexPath(), "path to local fingerprint index")
+	}
+	var downloadDir string
+	var downloadMax int64
+	for _, cmd := range []*flag.FlagSet{idCmd, srvCmd, indexAddCmd, sigComputeCmd} {
+		cmd.StringVar(&downloadDir, "downloads", defaultDownloadDir(), "directory for downloaded audio")
+		cmd.Int64Var(&downloadMax, "downloads-max", 2048, "maximum size of downloaded audio, in MiB; 0 for unlimited")
+	}
+	var cacheDir string
+	var cacheTTL time.Duration
+	var cacheMax int
+	for _, cmd := range []*flag.FlagSet{idCmd, srvCmd, cacheStatsCmd, cachePruneCmd, cacheClearCmd} {
+		cmd.StringVar(&cacheDir, "cache", defaultCacheDir(), "directory for cached identification results; empty to disable")
+		cmd.DurationVar(&cacheTTL, "cache-ttl", 30*24*time.Hour, "maximum age of cached results")
+		cmd.IntVar(&cacheMax, "cache-max", 100000, "maximum number of cached results")
+	}
 
 	cmd := flagg.Parse(flagg.Tree{
 		Cmd: rootCmd,
 		Sub: []flagg.Tree{
 			{Cmd: versionCmd},
 			{Cmd: idCmd},
+			{
+				Cmd: indexCmd,
+				Sub: []flagg.Tree{
+					{Cmd: indexAddCmd},
+					{Cmd: indexListCmd},
+					{Cmd: indexRemoveCmd},
+					{Cmd: indexStatsCmd},
+				},
+			},
+			{
+				Cmd: cacheCmd,
+				Sub: []flagg.Tree{
+					{Cmd: cacheStatsCmd},
+					{Cmd: cachePruneCmd},
+					{Cmd: cacheClearCmd},
+				},
+			},
+			{
+				Cmd: sigCmd,
+				Sub: []flagg.Tree{
+					{Cmd: sigComputeCmd},
+					{Cmd: sigInspectCmd},
+					{Cmd: sigSubmitCmd},
+				},
+			},
 			{Cmd: srvCmd},
 		},
 	})
 	args := cmd.Args()
+	linkPlatforms = parsePlatforms(platforms)
+	filter, err := parseFilterChain(retryFilter)
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+	if downloadDir == "" && (cmd == idCmd || cmd == srvCmd || cmd == indexAddCmd || cmd == sigComputeCmd) {
+		log.Fatalln("Error: --downloads must not be empty")
+	}
+	downloads = newDownloadCache(downloadDir, downloadMax<<20)
+	if cmd == idCmd || cmd == srvCmd {
+		maxDecodedSize = decodedMax << 20
+	}
+	var results *resultCache
+	if cacheDir != "" && recordDir == "" && replayDir == "" && (cmd == idCmd || cmd == srvCmd) {
+		// cached results would bypass the cassette, leaving gaps in a
+		// recording and hiding what a replay would return
+		results = newResultCache(cacheDir, cacheBackendKey(idCfg), cacheTTL, cacheMax)
+		if _, err := results.prune(); err != nil {
+			log.Fatalln("Error:", err)
+		}
+	}
+	if reqRate > 0 {
+		idCfg.limiter = rate.NewLimiter(rate.Limit(reqRate/60), 1)
+	}
+	linkClient := shazam.NewClient()
+	if hc, err := cassetteClient(recordDir, replayDir); err != nil {
+		log.Fatalln("Error:", err)
+	} else if hc != nil {
+		idCfg.httpClient = hc
+		linkClient = shazam.NewClient(shazam.WithHTTPClient(hc))
+		if replayDir != "" {
+			idCfg.limiter = rate.NewLimiter(rate.Inf, 1)
+		}
+	}
 
 	switch cmd {
 	case rootCmd, versionCmd:
@@ -60,6 +280,8 @@ func main() {
 		if len(args) != 1 {
 			cmd.Usage()
 			return
+		} else if *idSearch != "grid" && *idSearch != "adaptive" {
+			log.Fatalln("Error: unknown search strategy", *idSearch)
 		}
 		uri, isAlbum, err := resolveURI(args[0])
 		if err != nil {
@@ -69,21 +291,235 @@ func main() {
 		} else if isAlbum && *manual && *track == 0 {
 			log.Fatalln("Error: --manual flag is only valid for single tracks")
 		}
+		backend, err := newIdentifier(idCfg)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		opts := searchOptions{backend: backend, adaptive: *idSearch == "adaptive", timeline: *idTimeline, parallel: parallel, filter: filter, cache: results, links: linkClient, offline: replayDir != "", silent: *silent}
 		var m tea.Model
 		if isAlbum && *track == 0 {
-			m = newAlbumModel(uri)
+			m = newAlbumModel(uri, opts, *idJobs)
 		} else if *manual {
-			m = newManualModel(uri, *track)
+			m = newManualModel(uri, *track, opts)
 		} else {
-			m = newSingleModel(uri, *track)
+			m = newSingleModel(uri, *track, opts)
 		}
 		p := tea.NewProgram(m)
 		if _, err := p.Run(); err != nil {
 			log.Fatalln("Error:", err)
 		}
 
+	case indexCmd:
+		cmd.Usage()
+
+	case indexAddCmd:
+		if len(args) == 0 {
+			cmd.Usage()
+			return
+		}
+		idx, err := loadOrCreateIndex(idCfg.indexPath)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		var srcs []indexSource
+		for _, arg := range args {
+			s, release, err := collectIndexSources(arg)
+			if err != nil {
+				log.Fatalln("Error:", err)
+			}
+			defer release()
+			srcs = append(srcs, s...)
+		}
+		if err := indexFiles(idx, idCfg.indexPath, srcs); err != nil {
+			log.Fatalln("Error:", err)
+		}
+
+	case indexListCmd:
+		if len(args) != 0 {
+			cmd.Usage()
+			return
+		}
+		idx, err := loadOrCreateIndex(idCfg.indexPath)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, t := range idx.Tracks() {
+			fmt.Fprintf(tw, "%v\t%v - %v\t%v\t%v\n", t.ID, t.Artist, t.Title, renderDuration(t.Duration), t.Path)
+		}
+		tw.Flush()
+
+	case indexRemoveCmd:
+		if len(args) == 0 {
+			cmd.Usage()
+			return
+		}
+		idx, err := loadOrCreateIndex(idCfg.indexPath)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		removed := removeFromIndex(idx, args)
+		for _, t := range removed {
+			fmt.Printf("Removed %v - %v\n", t.Artist, t.Title)
+		}
+		if len(removed) == 0 {
+			log.Fatalln("Error: no matching tracks found")
+		} else if err := idx.Save(idCfg.indexPath); err != nil {
+			log.Fatalln("Error:", err)
+		}
+
+	case indexStatsCmd:
+		if len(args) != 0 {
+			cmd.Usage()
+			return
+		}
+		idx, err := loadOrCreateIndex(idCfg.indexPath)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		var total time.Duration
+		tracks := idx.Tracks()
+		for _, t := range tracks {
+			total += t.Duration
+		}
+		var size int64
+		if stat, err := os.Stat(idCfg.indexPath); err == nil {
+			size = stat.Size()
+		}
+		fmt.Println("Path:    ", idCfg.indexPath)
+		fmt.Println("Tracks:  ", len(tracks))
+		fmt.Println("Duration:", renderDuration(total))
+		fmt.Println("Hashes:  ", idx.NumHashes())
+		fmt.Printf("Size:     %.1f MiB\n", float64(size)/(1<<20))
+
+	case cacheCmd:
+		cmd.Usage()
+
+	case cacheStatsCmd, cachePruneCmd, cacheClearCmd:
+		if len(args) != 0 || cacheDir == "" {
+			cmd.Usage()
+			return
+		}
+		c := newResultCache(cacheDir, "", cacheTTL, cacheMax)
+		switch cmd {
+		case cacheStatsCmd:
+			es, err := c.entries()
+			if err != nil {
+				log.Fatalln("Error:", err)
+			}
+			var size int64
+			for _, e := range es {
+				size += e.size
+			}
+			fmt.Println("Path:   ", cacheDir)
+			fmt.Println("Entries:", len(es))
+			fmt.Printf("Size:    %.1f MiB\n", float64(size)/(1<<20))
+			if len(es) > 0 {
+				fmt.Println("Oldest: ", es[0].modTime.Format(time.DateTime))
+				fmt.Println("Newest: ", es[len(es)-1].modTime.Format(time.DateTime))
+			}
+		case cachePruneCmd:
+			n, err := c.prune()
+			if err != nil {
+				log.Fatalln("Error:", err)
+			}
+			fmt.Printf("Removed %v entries\n", n)
+		case cacheClearCmd:
+			n, err := c.clear()
+			if err != nil {
+				log.Fatalln("Error:", err)
+			}
+			fmt.Printf("Removed %v entries\n", n)
+		}
+
+	case sigCmd:
+		cmd.Usage()
+
+	case sigComputeCmd:
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		if *sigSpeed <= 0 || *sigTempo <= 0 {
+			log.Fatalln("Error: speed and tempo must be positive")
+		}
+		uri, isAlbum, err := resolveURI(args[0])
+		if err != nil {
+			log.Fatalln("Error:", err)
+		} else if isAlbum {
+			log.Fatalln("Error: signatures can only be computed for single tracks")
+		}
+		path, release, err := fetchTrack(uri, 10e9)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		params := newIdentifyParams(*sigSpeed, *sigTempo, *sigPitch)
+		params.offset = *sigOffset
+		if params.filter, err = parseFilterChain(*sigFilter); err != nil {
+			log.Fatalln("Error:", err)
+		}
+		sig, err := computeSignature(path, params, *sigDuration)
+		release()
+		if err != nil {
+			log.Fatalln("Error:", err)
+		} else if sig.NumSamples() == 0 {
+			log.Fatalln("Error: offset is past the end of the track")
+		}
+		if *sigFormat == "" {
+			*sigFormat = "base64"
+			if *sigOut != "" {
+				*sigFormat = "sig"
+			}
+		}
+		if err := writeSignature(sig, *sigOut, *sigFormat); err != nil {
+			log.Fatalln("Error:", err)
+		}
+
+	case sigInspectCmd:
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		sig, err := readSignature(args[0])
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		if *sigInspectJSON {
+			if err := writeSignatureJSON(os.Stdout, sig); err != nil {
+				log.Fatalln("Error:", err)
+			}
+		} else {
+			writeSignatureInfo(os.Stdout, sig)
+		}
+
+	case sigSubmitCmd:
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+		sig, err := readSignature(args[0])
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		backend, err := newIdentifier(idCfg)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		res, err := backend.Identify(context.Background(), sig)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		writeResult(os.Stdout, res)
+
 	case srvCmd:
-		srv, err := newServer(".")
+		if *srvSearch != "grid" && *srvSearch != "adaptive" {
+			log.Fatalln("Error: unknown search strategy", *srvSearch)
+		}
+		backend, err := newIdentifier(idCfg)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		srv, err := newServer(".", searchOptions{backend: backend, adaptive: *srvSearch == "adaptive", parallel: parallel, filter: filter, cache: results, links: linkClient, offline: replayDir != "", silent: true}, *srvJobs)
 		if err != nil {
 			log.Fatalln("Error:", err)
 		}
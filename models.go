@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -13,6 +13,7 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/mattn/go-runewidth"
+	"lukechampine.com/barbershop/shazam"
 )
 
 type (
@@ -21,16 +22,31 @@ type (
 		err error
 	}
 	msgFetchedTrack struct {
-		path string
+		info    trackInfo
+		release func() // allows the track's download to be evicted
 	}
 	msgFetchedPlaylist struct {
-		pl playlist
+		pl      playlist
+		release func()
+	}
+	msgFetchedAlbumTrack struct {
+		track *identifyTrackModel
+		info  trackInfo
 	}
 	msgIdentifyResult struct {
+		id *trackIdentifier
 		ir identifyResult
 	}
+	msgIdentifyError struct {
+		id  *trackIdentifier
+		err error
+	}
+	msgTrackError struct {
+		track *identifyTrackModel
+		err   error
+	}
 	msgLinks struct {
-		links map[string]string
+		links shazam.SongLinks
 	}
 )
 
@@ -38,32 +54,130 @@ func renderTime(offset time.Duration) string {
 	return fmt.Sprintf("%02v:%02v", int(offset.Minutes()), int((offset % time.Minute).Seconds()))
 }
 
+func renderRange(r timeRange) string {
+	return renderTime(r.start) + "–" + renderTime(r.end)
+}
+
+// renderPosition describes where the sample of r lies in the original song and
+// in the track.
+func renderPosition(r identifyResult) string {
+	return fmt.Sprintf("source %v → track %v", renderRange(r.source), renderRange(r.params.span(clipDuration)))
+}
+
+// renderLinks renders the links for linkPlatforms, followed by the song.link
+// page, which lists the rest.
+func renderLinks(links shazam.SongLinks, indent string) string {
+	shown := shownLinks(links.Platforms)
+	if len(shown) == 0 && links.PageURL == "" {
+		return indent + "Streaming links not found :/\n"
+	}
+	var sb strings.Builder
+	if links.LowConfidence {
+		fmt.Fprintf(&sb, "%vFound by ISRC or search; may not be the right song\n", indent)
+	}
+	for _, l := range shown {
+		fmt.Fprintf(&sb, "%v%v: %v\n", indent, l.Name, l.URL)
+	}
+	if links.PageURL != "" {
+		fmt.Fprintf(&sb, "%vMore: %v\n", indent, links.PageURL)
+	}
+	return sb.String()
+}
+
 func renderRatio(ratio float64) string {
 	color := lipgloss.Color([]string{
 		"129", "039", "050",
 		"046", "190", "226",
 		"208", "202", "196",
 	}[min(max(int(math.Round(20*ratio)-14)/2, 0), 8)])
-	return lipgloss.NewStyle().Foreground(color).Render(fmt.Sprintf("%.2fx", ratio))
+	s := fmt.Sprintf("%.2fx", ratio)
+	if math.Abs(100*ratio-math.Round(100*ratio)) > 1e-6 {
+		// refined speeds are more precise
+		s = fmt.Sprintf("%.3fx", ratio)
+	}
+	return lipgloss.NewStyle().Foreground(color).Render(s)
+}
+
+func renderParams(p identifyParams) string {
+	s := renderRatio(p.ratio)
+	if p.tempo != 1 {
+		s = renderRatio(p.tempo) + " tempo"
+	}
+	if p.pitch != 0 {
+		s += fmt.Sprintf(" %+gst", p.pitch)
+	}
+	if p.effect != 0 {
+		s += fmt.Sprintf(", %v", p.effect)
+	}
+	if p.filter != 0 {
+		s += fmt.Sprintf(" (%v)", p.filter)
+	}
+	return s
+}
+
+func renderTimeline(timeline []timelineEntry) string {
+	italics := lipgloss.NewStyle().Italic(true).Render
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "  Timeline:\n")
+	for _, e := range timeline {
+		ranges := make([]string, len(e.ranges))
+		for i, r := range e.ranges {
+			ranges[i] = renderRange(r)
+		}
+		fmt.Fprintf(&sb, "   %v @ %v: %v\n", italics(e.res.Artist+" - "+e.res.Title), renderParams(e.params), strings.Join(ranges, ", "))
+	}
+	return sb.String()
+}
+
+// cmdQueries issues the next queries of id. If audible, playback follows the
+// speed of the clip currently being identified.
+func cmdQueries(ctx context.Context, id *trackIdentifier, audible bool) tea.Cmd {
+	qs := id.queries()
+	cmds := make([]tea.Cmd, 0, len(qs)+1)
+	if audible {
+		p := id.currentParams()
+		cmds = append(cmds, func() tea.Msg {
+			boomboxChangeSpeed(p.speed())
+			return nil
+		})
+	}
+	for _, p := range qs {
+		p := p
+		cmds = append(cmds, func() tea.Msg {
+			res, err := identifyPath(ctx, id.backend, id.cache, id.path, p)
+			if ctx.Err() != nil {
+				return nil // canceled
+			} else if err != nil {
+				return msgIdentifyError{id, err}
+			}
+			return msgIdentifyResult{id, res}
+		})
+	}
+	return tea.Batch(cmds...)
 }
 
 func cmdFetchTrack(uri mediaURI) tea.Cmd {
 	return func() tea.Msg {
-		path, err := fetchTrack(uri, 10e9)
+		path, release, err := fetchTrack(uri, 10e9)
 		if err != nil {
 			return msgError{err}
 		}
-		return msgFetchedTrack{path}
+		info, err := analyzeTrack(path)
+		if err != nil {
+			release()
+			return msgError{err}
+		}
+		return msgFetchedTrack{info, release}
 	}
 }
 
 func cmdFetchPlaylist(uri mediaURI) tea.Cmd {
 	return func() tea.Msg {
-		pl, err := fetchPlaylist(uri)
+		pl, release, err := fetchPlaylist(uri)
 		if err != nil {
 			return msgError{err}
 		}
-		return msgFetchedPlaylist{pl}
+		return msgFetchedPlaylist{pl, release}
 	}
 }
 
@@ -75,9 +189,21 @@ func cmdFetchPlaylistTrack(uri mediaURI, track int) tea.Cmd {
 			return r
 		}
 		if track < 1 || track > len(pl.pl.Entries) {
+			pl.release()
 			return msgError{errors.New("invalid track number")}
 		}
-		return cmdFetchTrack(pl.pl.Entries[track-1].URI)()
+		r = cmdFetchTrack(pl.pl.Entries[track-1].URI)()
+		if t, ok := r.(msgFetchedTrack); ok {
+			// the track may live in the playlist's download
+			releaseTrack := t.release
+			t.release = func() {
+				releaseTrack()
+				pl.release()
+			}
+			return t
+		}
+		pl.release()
+		return r
 	}
 }
 
@@ -154,15 +280,24 @@ type identifyTrackModel struct {
 	uri     mediaURI
 	title   string
 	status  string
+	opts    searchOptions
 	id      *trackIdentifier
+	audible bool
+	err     error
 	spinner spinnerModel
+	ctx     context.Context
+	cancel  context.CancelFunc
 }
 
-func newIdentifyTrackModel(uri mediaURI, title string) *identifyTrackModel {
+func newIdentifyTrackModel(ctx context.Context, uri mediaURI, title string, opts searchOptions) *identifyTrackModel {
+	ctx, cancel := context.WithCancel(ctx)
 	return &identifyTrackModel{
 		uri:    uri,
 		title:  title,
 		status: "queued",
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
 		spinner: newSpinner(spinner.Spinner{
 			Frames: spinner.Line.Frames,
 			FPS:    time.Second / 6,
@@ -172,50 +307,59 @@ func newIdentifyTrackModel(uri mediaURI, title string) *identifyTrackModel {
 
 func (m *identifyTrackModel) init() tea.Cmd {
 	m.status = "fetching"
-	return tea.Batch(m.spinner.tick, cmdFetchTrack(m.uri))
+	fetch := cmdFetchTrack(m.uri)
+	return tea.Batch(m.spinner.tick, func() tea.Msg {
+		msg := fetch()
+		switch msg := msg.(type) {
+		case msgFetchedTrack:
+			// the download is no longer needed once the track is done, skipped,
+			// or failed
+			context.AfterFunc(m.ctx, msg.release)
+			return msgFetchedAlbumTrack{m, msg.info}
+		case msgError:
+			return msgTrackError{m, msg.err}
+		}
+		return msg
+	})
 }
 
-func (m *identifyTrackModel) cmdStartIdentifying(path string) tea.Cmd {
+func (m *identifyTrackModel) cmdStartIdentifying(info trackInfo) tea.Cmd {
 	m.status = "identifying"
-	m.id = newTrackIdentifier(path)
-	return tea.Sequence(
-		func() tea.Msg {
-			if err := boomboxFadeIn(path); err != nil {
-				return msgError{err}
-			}
-			return nil
-		},
-		m.cmdTryNextParams(m.id.currentParams()),
-	)
+	m.id = newTrackIdentifier(m.opts, info)
+	if !m.audible {
+		return cmdQueries(m.ctx, m.id, false)
+	}
+	return tea.Sequence(m.cmdFadeIn(), cmdQueries(m.ctx, m.id, true))
 }
 
-func (m *identifyTrackModel) cmdHandleResult(r identifyResult) tea.Cmd {
-	nextParams := m.id.handleResult(r)
-	if nextParams == nil {
-		m.status = "done"
+func (m *identifyTrackModel) cmdFadeIn() tea.Cmd {
+	path := m.id.path
+	return func() tea.Msg {
+		if err := boomboxFadeIn(path); err != nil {
+			return msgTrackError{m, err}
+		}
 		return nil
 	}
-	return m.cmdTryNextParams(*nextParams)
 }
 
-func (m *identifyTrackModel) cmdTryNextParams(p identifyParams) tea.Cmd {
-	return tea.Batch(
-		func() tea.Msg {
-			boomboxChangeSpeed(p.ratio)
-			return nil
-		},
-		func() tea.Msg {
-			res, err := identifyPath(m.id.path, p)
-			if err != nil {
-				return msgError{err}
-			}
-			return msgIdentifyResult{res}
-		},
-	)
+func (m *identifyTrackModel) cmdHandleResult(r identifyResult) tea.Cmd {
+	if m.id.addResult(r) {
+		m.status = "done"
+		m.cancel()
+		return nil
+	}
+	return cmdQueries(m.ctx, m.id, m.audible)
 }
 
 func (m *identifyTrackModel) skip() {
 	m.status = "skipped"
+	m.cancel()
+}
+
+func (m *identifyTrackModel) fail(err error) {
+	m.status = "failed"
+	m.err = err
+	m.cancel()
 }
 
 func (m *identifyTrackModel) render() string {
@@ -235,12 +379,16 @@ func (m *identifyTrackModel) render() string {
 		} else if p.offset == 60*time.Second {
 			dots = "✔✔?"
 		}
-		fmt.Fprintf(&sb, "(%v)  Trying %v %v  (%v)", m.spinner.view(), renderRatio(p.ratio), dots, m.spinner.view())
+		fmt.Fprintf(&sb, "(%v)  Trying %v %v  (%v)", m.spinner.view(), renderParams(p), dots, m.spinner.view())
 	case "skipped":
 		fmt.Fprintf(&sb, "<skipped>")
+	case "failed":
+		fmt.Fprintf(&sb, "X  Failed: %v", m.err)
 	case "done":
-		if s := m.id.sample; s != nil {
-			fmt.Fprintf(&sb, "✔  %v - %v (%.0f%% match @ %v speed)", s.res.Artist, s.res.Title, 100*(1-s.skew), s.params.ratio)
+		if len(m.id.timeline) > 1 {
+			fmt.Fprintf(&sb, "✔  %v samples: %v - %v, ...", len(m.id.timeline), m.id.sample.res.Artist, m.id.sample.res.Title)
+		} else if s := m.id.sample; s != nil {
+			fmt.Fprintf(&sb, "✔  %v - %v (%.0f%% match @ %v; %v)", s.res.Artist, s.res.Title, 100*(1-s.skew), renderParams(s.params), renderPosition(*s))
 		} else {
 			fmt.Fprintf(&sb, "X  Match not found :/")
 		}
@@ -250,21 +398,73 @@ func (m *identifyTrackModel) render() string {
 
 type identifyAlbumModel struct {
 	uri   mediaURI
+	opts  searchOptions
 	title string
 	width int
 	err   error
 
 	// submodels
-	spinner    spinnerModel
-	tracks     []*identifyTrackModel
-	trackIndex int
+	spinner spinnerModel
+	tracks  []*identifyTrackModel
+	jobs    int // maximum number of tracks in progress at once
+	next    int // index of the next track to start
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func newAlbumModel(uri mediaURI) *identifyAlbumModel {
+func newAlbumModel(uri mediaURI, opts searchOptions, jobs int) *identifyAlbumModel {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &identifyAlbumModel{
 		uri:     uri,
+		opts:    opts,
+		jobs:    max(jobs, 1),
 		spinner: newSpinner(spinner.Moon),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (m *identifyAlbumModel) inProgress() (ts []*identifyTrackModel) {
+	for _, t := range m.tracks {
+		if t.status == "fetching" || t.status == "identifying" {
+			ts = append(ts, t)
+		}
+	}
+	return
+}
+
+// advance starts queued tracks, hands playback to another track if the
+// audible track has finished, and quits once every track has finished.
+func (m *identifyAlbumModel) advance() tea.Cmd {
+	var cmds []tea.Cmd
+	for len(m.inProgress()) < m.jobs && m.next < len(m.tracks) {
+		cmds = append(cmds, m.tracks[m.next].init())
+		m.next++
+	}
+	active := m.inProgress()
+	if len(active) == 0 {
+		if !m.opts.silent {
+			boomboxFadeOut()
+		}
+		m.cancel()
+		return tea.Quit
+	} else if m.opts.silent {
+		return tea.Batch(cmds...)
+	}
+	audible := false
+	for _, t := range active {
+		audible = audible || t.audible
+	}
+	if !audible {
+		// the first track still fetching will fade in once it is identifying
+		t := active[0]
+		t.audible = true
+		if t.status == "identifying" {
+			cmds = append(cmds, tea.Sequence(t.cmdFadeIn(), cmdQueries(t.ctx, t.id, true)))
+		}
 	}
+	return tea.Batch(cmds...)
 }
 
 func (m *identifyAlbumModel) Init() tea.Cmd {
@@ -280,19 +480,15 @@ func (m *identifyAlbumModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "ctrl+c", "q":
+			m.cancel()
 			cmds = append(cmds, tea.Quit)
 		case "s":
-			if len(m.tracks) == 0 || m.trackIndex >= len(m.tracks) {
+			active := m.inProgress()
+			if len(active) == 0 {
 				return m, nil
 			}
-			m.tracks[m.trackIndex].skip()
-			m.trackIndex++
-			if m.trackIndex < len(m.tracks) {
-				cmds = append(cmds, m.tracks[m.trackIndex].init())
-			} else {
-				boomboxFadeOut()
-				cmds = append(cmds, tea.Quit)
-			}
+			active[0].skip()
+			cmds = append(cmds, m.advance())
 		}
 
 	case msgError:
@@ -306,6 +502,7 @@ func (m *identifyAlbumModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 	case msgFetchedPlaylist:
+		context.AfterFunc(m.ctx, msg.release)
 		m.title = msg.pl.Title
 		for _, t := range msg.pl.Entries {
 			if n := runewidth.StringWidth(t.Title); n > m.width {
@@ -314,26 +511,37 @@ func (m *identifyAlbumModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		m.tracks = make([]*identifyTrackModel, len(msg.pl.Entries))
 		for i, t := range msg.pl.Entries {
-			m.tracks[i] = newIdentifyTrackModel(t.URI, t.Title)
+			m.tracks[i] = newIdentifyTrackModel(m.ctx, t.URI, t.Title, m.opts)
 		}
 		// TODO: handle empty playlists
-		cmds = append(cmds, m.tracks[0].init())
+		cmds = append(cmds, m.advance())
 
-	case msgFetchedTrack:
-		cmds = append(cmds, m.tracks[m.trackIndex].cmdStartIdentifying(msg.path))
+	case msgFetchedAlbumTrack:
+		if msg.track.status == "fetching" {
+			cmds = append(cmds, msg.track.cmdStartIdentifying(msg.info))
+		}
 
-	case msgIdentifyResult:
-		if m.trackIndex >= len(m.tracks) || msg.ir.params != m.tracks[m.trackIndex].id.currentParams() {
-			break
+	case msgTrackError:
+		if t := msg.track; t.status == "fetching" || t.status == "identifying" {
+			t.fail(msg.err)
+			cmds = append(cmds, m.advance())
 		}
-		cmds = append(cmds, m.tracks[m.trackIndex].cmdHandleResult(msg.ir))
-		if m.tracks[m.trackIndex].status == "done" {
-			m.trackIndex++
-			if m.trackIndex < len(m.tracks) {
-				cmds = append(cmds, m.tracks[m.trackIndex].init())
-			} else {
-				boomboxFadeOut()
-				cmds = append(cmds, tea.Quit)
+
+	case msgIdentifyError:
+		for _, t := range m.tracks {
+			if t.id == msg.id && t.status == "identifying" {
+				t.fail(msg.err)
+				cmds = append(cmds, m.advance())
+			}
+		}
+
+	case msgIdentifyResult:
+		for _, t := range m.tracks {
+			if t.id == msg.id && t.status == "identifying" {
+				cmds = append(cmds, t.cmdHandleResult(msg.ir))
+				if t.status == "done" {
+					cmds = append(cmds, m.advance())
+				}
 			}
 		}
 	}
@@ -359,6 +567,7 @@ func (m *identifyAlbumModel) View() string {
 type cassetteModel struct {
 	speedup float64
 	offset  time.Duration
+	bpm     float64
 	gears   spinnerModel
 	noise   spinnerModel
 }
@@ -404,6 +613,11 @@ func (m *cassetteModel) render() string {
 	}
 
 	pos, duration, ratio := boomboxState()
+	label := strings.Repeat("─", 22)
+	if m.bpm > 0 {
+		bpm := fmt.Sprintf(" %.0f BPM ", m.bpm)
+		label = strings.Repeat("─", (22-len(bpm))/2) + bpm + strings.Repeat("─", 22-len(bpm)-(22-len(bpm))/2)
+	}
 	seekbar := []rune(strings.Repeat("▱", 9))
 	copy(seekbar[:min(8, int(9*float64(pos)/float64(duration)))], []rune(strings.Repeat("▰", 9)))
 	return fmt.Sprintf(""+
@@ -414,7 +628,7 @@ func (m *cassetteModel) render() string {
 		"│ │: │   ,─.   ▁▁▁▁▁   ,─.  │ :│\n"+
 		"│ │: │  ( %v)) [▁▁▁▁▁] ( %v)) │ :│\n"+
 		"│v│: │   `─`   ' ' '   `─`  │ :│\n"+
-		"│││: └──────────────────────┘ :│\n"+
+		"│││: └%v┘ :│\n"+
 		"│││.....\u2571::::o::::::o::::╲.....│\n"+
 		"│^│....\u2571:::O::::::::::O:::╲....│\n"+
 		"│\u2571`───\u2571────────────────────`───│\n"+
@@ -422,7 +636,8 @@ func (m *cassetteModel) render() string {
 		"     `────────────────────'\n",
 		m.noise.view(), renderRatio(ratio), runewidth.Truncate(reverse(m.noise.view()), 8, ""),
 		renderTime(pos), string(seekbar), renderTime(duration),
-		m.gears.view(), m.gears.view())
+		m.gears.view(), m.gears.view(),
+		label)
 }
 
 type historyModel struct {
@@ -445,9 +660,9 @@ func (m *historyModel) render(n int) string {
 	for i := max(0, len(m.entries)-n); i < len(m.entries); i++ {
 		r := m.entries[i]
 		if r.res.Found {
-			fmt.Fprintf(&sb, "%v  %v @ %v: %v (%.0f%% match)\n", green("✔️"), renderTime(r.params.offset), renderRatio(r.params.ratio), italics(r.res.Artist+" - "+r.res.Title), 100*(1-r.skew))
+			fmt.Fprintf(&sb, "%v  %v @ %v: %v (%.0f%% match)\n", green("✔️"), renderTime(r.params.offset), renderParams(r.params), italics(r.res.Artist+" - "+r.res.Title), 100*(1-r.skew))
 		} else {
-			fmt.Fprintf(&sb, "%v  %v @ %v: <no match>\n", red("X"), renderTime(r.params.offset), renderRatio(r.params.ratio))
+			fmt.Fprintf(&sb, "%v  %v @ %v: <no match>\n", red("X"), renderTime(r.params.offset), renderParams(r.params))
 		}
 	}
 	return sb.String()
@@ -456,19 +671,27 @@ func (m *historyModel) render(n int) string {
 type identifySingleModel struct {
 	uri        mediaURI
 	albumIndex int
+	opts       searchOptions
 	id         *trackIdentifier
 	moon       spinnerModel
 	ellipsis   spinnerModel
 	cassette   *cassetteModel
 	history    *historyModel
-	links      map[string]string
+	links      *shazam.SongLinks
 	err        error
+	release    func() // releases the track's download
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
-func newSingleModel(uri mediaURI, albumIndex int) *identifySingleModel {
+func newSingleModel(uri mediaURI, albumIndex int, opts searchOptions) *identifySingleModel {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &identifySingleModel{
 		uri:        uri,
 		albumIndex: albumIndex,
+		opts:       opts,
+		ctx:        ctx,
+		cancel:     cancel,
 		moon:       newSpinner(spinner.Moon),
 		ellipsis: newSpinner(spinner.Spinner{
 			Frames: spinner.Ellipsis.Frames,
@@ -480,6 +703,9 @@ func newSingleModel(uri mediaURI, albumIndex int) *identifySingleModel {
 }
 
 func (m *identifySingleModel) cmdStartIdentifying(path string) tea.Cmd {
+	if m.opts.silent {
+		return cmdQueries(m.ctx, m.id, false)
+	}
 	return tea.Sequence(
 		func() tea.Msg {
 			if err := boomboxFadeIn(path); err != nil {
@@ -487,23 +713,7 @@ func (m *identifySingleModel) cmdStartIdentifying(path string) tea.Cmd {
 			}
 			return nil
 		},
-		m.cmdTryNextParams(m.id.currentParams()),
-	)
-}
-
-func (m *identifySingleModel) cmdTryNextParams(p identifyParams) tea.Cmd {
-	return tea.Batch(
-		func() tea.Msg {
-			boomboxChangeSpeed(p.ratio)
-			return nil
-		},
-		func() tea.Msg {
-			res, err := identifyPath(m.id.path, p)
-			if err != nil {
-				return msgError{err}
-			}
-			return msgIdentifyResult{res}
-		},
+		cmdQueries(m.ctx, m.id, true),
 	)
 }
 
@@ -521,6 +731,7 @@ func (m *identifySingleModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "ctrl+c", "q":
+			m.cancel()
 			cmds = append(cmds, tea.Quit)
 		}
 
@@ -528,6 +739,11 @@ func (m *identifySingleModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.err = msg.err
 		cmds = append(cmds, tea.Quit)
 
+	case msgIdentifyError:
+		m.err = msg.err
+		m.cancel()
+		cmds = append(cmds, tea.Quit)
+
 	case spinner.TickMsg:
 		if m.id != nil {
 			_, _, ratio := boomboxState()
@@ -538,25 +754,34 @@ func (m *identifySingleModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		cmds = append(cmds, m.moon.update(msg), m.ellipsis.update(msg), m.cassette.update(msg))
 
 	case msgFetchedTrack:
-		m.id = newTrackIdentifier(msg.path)
-		cmds = append(cmds, m.cmdStartIdentifying(msg.path))
+		m.id = newTrackIdentifier(m.opts, msg.info)
+		m.cassette.bpm = msg.info.bpm
+		m.release = msg.release
+		context.AfterFunc(m.ctx, m.release)
+		cmds = append(cmds, m.cmdStartIdentifying(msg.info.path))
 
 	case msgIdentifyResult:
+		if m.id.done {
+			break // a straggling query
+		}
 		m.history.add(msg.ir)
-		if nextParams := m.id.handleResult(msg.ir); nextParams == nil {
+		if m.id.addResult(msg.ir) {
+			m.release() // playback doesn't read the file
 			if m.id.sample != nil {
-				cmds = append(cmds, cmdFetchLinks(m.id.sample.res.AppleID))
+				cmds = append(cmds, cmdFetchLinks(m.ctx, m.opts, m.id.sample.res))
 			} else {
 				m.err = fmt.Errorf("no match found")
 				cmds = append(cmds, tea.Quit)
 			}
 		} else {
-			cmds = append(cmds, m.cmdTryNextParams(*nextParams))
+			cmds = append(cmds, cmdQueries(m.ctx, m.id, !m.opts.silent))
 		}
 
 	case msgLinks:
-		m.links = msg.links
-		boomboxFadeOut()
+		m.links = &msg.links
+		if !m.opts.silent {
+			boomboxFadeOut()
+		}
 		cmds = append(cmds, tea.Quit)
 	}
 	return m, tea.Batch(cmds...)
@@ -570,12 +795,15 @@ func (m *identifySingleModel) View() string {
 		waiting := ""
 		if m.id.sample == nil {
 			p := m.id.currentParams()
-			waiting = fmt.Sprintf("?  %v @ %v: %v\n", renderTime(p.offset), renderRatio(p.ratio), m.ellipsis.view())
+			waiting = fmt.Sprintf("?  %v @ %v: %v\n", renderTime(p.offset), renderParams(p), m.ellipsis.view())
 		}
 		sb.WriteString(lipgloss.JoinHorizontal(lipgloss.Top,
 			lipgloss.NewStyle().MarginLeft(4).MarginRight(4).Render(m.cassette.render()),
 			lipgloss.JoinVertical(lipgloss.Left, lipgloss.NewStyle().Underline(true).Render("\nMatches:\n"), m.history.render(8)+waiting),
 		))
+		if len(m.id.timeline) > 0 && m.id.sample != nil {
+			fmt.Fprintf(&sb, "\n%v", renderTimeline(m.id.timeline))
+		}
 		if m.id.sample != nil {
 			italics := lipgloss.NewStyle().Italic(true).Render
 			fmt.Fprintf(&sb, "\n  ✔️  %v\n", italics(m.id.sample.res.Artist+" - "+m.id.sample.res.Title))
@@ -586,20 +814,30 @@ func (m *identifySingleModel) View() string {
 				}
 				fmt.Fprintf(&sb, "\n")
 			}
+			var details []string
+			for _, d := range []string{m.id.sample.res.Genre, m.id.sample.res.Label} {
+				if d != "" {
+					details = append(details, d)
+				}
+			}
+			if m.id.sample.res.ISRC != "" {
+				details = append(details, "ISRC "+m.id.sample.res.ISRC)
+			}
+			if m.id.sample.res.Key != "" {
+				details = append(details, keyLabel(m.opts.backend)+" "+m.id.sample.res.Key)
+			}
+			if len(details) > 0 {
+				fmt.Fprintf(&sb, "     %v\n", strings.Join(details, " · "))
+			}
+			fmt.Fprintf(&sb, "     %v\n", renderPosition(*m.id.sample))
+			if m.id.sample.res.CoverArt != "" {
+				fmt.Fprintf(&sb, "     Cover art: %v\n", m.id.sample.res.CoverArt)
+			}
 			fmt.Fprintf(&sb, "\n")
 			if m.links == nil {
 				fmt.Fprintf(&sb, "%v Fetching links\n", m.moon.view())
-			} else if len(m.links) == 0 {
-				fmt.Fprintf(&sb, "   Streaming links not found :/\n")
 			} else {
-				sites := make([]string, 0, len(m.links))
-				for site := range m.links {
-					sites = append(sites, site)
-				}
-				sort.Strings(sites)
-				for _, site := range sites {
-					fmt.Fprintf(&sb, "  %v: %v\n", site, m.links[site])
-				}
+				sb.WriteString(renderLinks(*m.links, "  "))
 			}
 		}
 	}
@@ -613,6 +851,7 @@ func (m *identifySingleModel) View() string {
 type identifyManualModel struct {
 	uri        mediaURI
 	albumIndex int
+	opts       searchOptions
 	path       string
 	params     identifyParams
 	trying     *identifyParams
@@ -621,15 +860,22 @@ type identifyManualModel struct {
 	ellipsis   spinnerModel
 	cassette   *cassetteModel
 	history    *historyModel
-	links      map[string]string
+	links      *shazam.SongLinks
+	linking    bool
 	err        error
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
-func newManualModel(uri mediaURI, albumIndex int) *identifyManualModel {
+func newManualModel(uri mediaURI, albumIndex int, opts searchOptions) *identifyManualModel {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &identifyManualModel{
 		uri:        uri,
 		albumIndex: albumIndex,
-		params:     identifyParams{ratio: 1, offset: 0 * time.Second},
+		opts:       opts,
+		ctx:        ctx,
+		cancel:     cancel,
+		params:     newIdentifyParams(1, 1, 0),
 		moon:       newSpinner(spinner.Moon),
 		ellipsis: newSpinner(spinner.Spinner{
 			Frames: spinner.Ellipsis.Frames,
@@ -641,13 +887,15 @@ func newManualModel(uri mediaURI, albumIndex int) *identifyManualModel {
 }
 
 func (m *identifyManualModel) cmdTryParams() tea.Cmd {
-	path, params := m.path, m.params
+	ctx, opts, path, params := m.ctx, m.opts, m.path, m.params
 	return func() tea.Msg {
-		res, err := identifyPath(path, params)
-		if err != nil {
+		res, err := identifyPath(ctx, opts.backend, opts.cache, path, params)
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
 			return msgError{err}
 		}
-		return msgIdentifyResult{res}
+		return msgIdentifyResult{nil, res}
 	}
 }
 
@@ -678,17 +926,19 @@ func (m *identifyManualModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 			boomboxSeek(delta)
 		case "enter":
-			m.params.offset, _, _ = boomboxState()
+			pos, _, _ := boomboxState()
+			m.params = m.params.at(pos)
 			p := m.params
 			m.trying = &p
-			m.links = nil
+			m.links, m.linking = nil, false
 			cmds = append(cmds, m.cmdTryParams())
 		case "l":
 			if len(m.history.entries) > 0 && m.history.entries[len(m.history.entries)-1].res.Found {
-				m.links = make(map[string]string)
-				cmds = append(cmds, cmdFetchLinks(m.history.entries[len(m.history.entries)-1].res.AppleID))
+				m.links, m.linking = nil, true
+				cmds = append(cmds, cmdFetchLinks(m.ctx, m.opts, m.history.entries[len(m.history.entries)-1].res))
 			}
 		case "ctrl+c", "q":
+			m.cancel()
 			cmds = append(cmds, tea.Quit)
 		}
 		cmds = append(cmds, m.highlight.cmdHighlight(msg.String()))
@@ -710,9 +960,14 @@ func (m *identifyManualModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		cmds = append(cmds, m.moon.update(msg), m.ellipsis.update(msg), m.cassette.update(msg))
 
 	case msgFetchedTrack:
-		m.path = msg.path
+		m.path = msg.info.path
+		m.cassette.bpm = msg.info.bpm
+		context.AfterFunc(m.ctx, msg.release) // the track is read until quitting
+		if m.opts.silent {
+			break
+		}
 		cmds = append(cmds, func() tea.Msg {
-			if err := boomboxFadeIn(msg.path); err != nil {
+			if err := boomboxFadeIn(msg.info.path); err != nil {
 				return msgError{err}
 			}
 			return nil
@@ -723,9 +978,8 @@ func (m *identifyManualModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.history.add(msg.ir)
 
 	case msgLinks:
-		m.links = msg.links
-		if len(m.links) == 0 {
-			m.links["Error"] = "Streaming links not found :/"
+		if m.linking {
+			m.links, m.linking = &msg.links, false
 		}
 	}
 	return m, tea.Batch(cmds...)
@@ -739,22 +993,13 @@ func (m *identifyManualModel) View() string {
 	} else {
 		waiting := ""
 		if m.trying != nil {
-			waiting = fmt.Sprintf("?  %v @ %v: %v\n", renderTime(m.trying.offset), renderRatio(m.trying.ratio), m.ellipsis.view())
+			waiting = fmt.Sprintf("?  %v @ %v: %v\n", renderTime(m.trying.offset), renderParams(*m.trying), m.ellipsis.view())
 		}
 		links := ""
-		if m.links != nil {
-			if len(m.links) == 0 {
-				links = "   " + m.moon.view() + " Fetching links...\n"
-			} else {
-				sites := make([]string, 0, len(m.links))
-				for site := range m.links {
-					sites = append(sites, site)
-				}
-				sort.Strings(sites)
-				for _, site := range sites {
-					links += fmt.Sprintf("   %v: %v\n", site, m.links[site])
-				}
-			}
+		if m.linking {
+			links = "   " + m.moon.view() + " Fetching links...\n"
+		} else if m.links != nil {
+			links = renderLinks(*m.links, "   ")
 		}
 		sb.WriteString(lipgloss.JoinHorizontal(lipgloss.Top,
 			lipgloss.NewStyle().MarginLeft(4).MarginRight(4).Render(m.cassette.render()),
@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"path"
@@ -16,7 +18,6 @@ import (
 	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"lukechampine.com/barbershop/shazam"
 )
 
 var templRoot = template.Must(template.New("root").Parse(`
@@ -107,6 +108,7 @@ var templRoot = template.Must(template.New("root").Parse(`
     <form hx-post="/identify" hx-target="#result-container" class="mb-6">
       <div class="flex items-center border-b border-gray-400 pb-2">
         <input class="appearance-none bg-transparent border-none w-full text-gray-700 mr-3 py-1 px-2 leading-tight focus:outline-none" type="text" placeholder="YouTube or Bandcamp URL" aria-label="URL" name="uri" required>
+        <label class="flex-shrink-0 text-sm text-gray-700 mr-3"><input type="checkbox" name="mode" value="timeline"> Timeline</label>
         <button class="flex-shrink-0 bg-blue-500 hover:bg-blue-700 border-blue-500 hover:border-blue-700 text-sm border-4 text-white py-1 px-2 rounded" type="submit">
           Submit
         </button>
@@ -139,6 +141,10 @@ var templJob = template.Must(template.New("job").Funcs(template.FuncMap{
 		url = strings.Replace(url, "open.spotify.com", "embed.spotify.com", 1)
 		return url
 	},
+	"platforms": shownLinks,
+	"timestamp": func(ms int64) string {
+		return renderTime(time.Duration(ms) * time.Millisecond)
+	},
 }).Parse(`
 {{ if ne .State "done" }}
 	<div hx-get="/job/{{ .ID }}" hx-trigger="load delay:1s" hx-swap="outerHTML">
@@ -150,13 +156,34 @@ var templJob = template.Must(template.New("job").Funcs(template.FuncMap{
 	{{ with .Sample }}
 		{{ if .Found }}
 			<div class="fade-in">
-				<h2 class="text-lg text-gray-800 mb-2">Original sample: <span class="font-bold">{{ .Artist }} — {{ .Title }}</span></h2>
+				<div class="flex items-center mb-2">
+					{{ with .CoverArt }}<img src="{{ . }}" width="64" height="64" class="rounded mr-3">{{ end }}
+					<div>
+						<h2 class="text-lg text-gray-800">Original sample: <span class="font-bold">{{ .Artist }} — {{ .Title }}</span></h2>
+						<p class="text-sm text-gray-600">
+							{{ with .Album }}{{ . }}{{ end }}{{ with .Year }} ({{ . }}){{ end }}
+							{{ with .Genre }} · {{ . }}{{ end }}{{ with .Label }} · {{ . }}{{ end }}
+						</p>
+						<p class="text-sm text-gray-600">
+							source {{ timestamp .Source.Start }}–{{ timestamp .Source.End }} → track {{ timestamp .Track.Start }}–{{ timestamp .Track.End }}
+						</p>
+					</div>
+				</div>
+				{{ if .LinksGuess }}
+					<p class="text-sm text-yellow-700 mb-2">These links were found by ISRC or search, and may not be the right song.</p>
+				{{ end }}
 				<div class="link-container">
-					{{ with (index .Links "YouTube") }}
-						<iframe src="{{ embed . }}" height="400px"></iframe>
+					{{ range (platforms .Links) }}
+						{{ if eq .Name "YouTube" }}
+							<iframe src="{{ embed .URL }}" height="400px"></iframe>
+						{{ else if eq .Name "Spotify" }}
+							<iframe src="{{ embed .URL }}" height="100px"></iframe>
+						{{ else }}
+							<a href="{{ .URL }}" class="text-blue-600 underline mr-3">{{ .Name }}</a>
+						{{ end }}
 					{{ end }}
-					{{ with (index .Links "Spotify") }}
-						<iframe src="{{ embed . }}" height="100px"></iframe>
+					{{ with .LinksPage }}
+						<a href="{{ . }}" class="text-blue-600 underline">More platforms</a>
 					{{ end }}
 				</div>
 			</div>
@@ -164,33 +191,87 @@ var templJob = template.Must(template.New("job").Funcs(template.FuncMap{
 			<div>Sample not found :(</div>
 		{{ end }}
 	{{ end}}
+	{{ if gt (len .Timeline) 1 }}
+		<div class="fade-in mt-4">
+			<h2 class="text-lg text-gray-800 mb-2">Timeline:</h2>
+			<ul class="mb-4">
+			{{ range .Timeline }}
+				<li><span class="font-bold">{{ .Artist }} — {{ .Title }}</span>:
+				{{ range $i, $r := .Ranges }}{{ if $i }}, {{ end }}{{ timestamp $r.Start }}–{{ timestamp $r.End }}{{ end }}</li>
+			{{ end }}
+			</ul>
+		</div>
+	{{ end }}
 {{ end }}
 `))
 
-func jobID(uri string) string {
+func jobID(uri, mode string) string {
+	if mode != "" {
+		uri += "#" + mode
+	}
 	h := sha256.Sum256([]byte(uri))
 	return fmt.Sprintf("%x", h[:8])
 }
 
+type sampleParams struct {
+	Speed     float64 `json:"speed"`
+	Tempo     float64 `json:"tempo,omitempty"`
+	Pitch     float64 `json:"pitch,omitempty"`
+	Effect    string  `json:"effect,omitempty"`
+	Filter    string  `json:"filter,omitempty"`
+	Timestamp int64   `json:"timestamp"`
+}
+
 type sampleEntry struct {
-	Found  bool `json:"found"`
-	Params struct {
-		Speed     float64 `json:"speed"`
-		Timestamp int64   `json:"timestamp"`
-	} `json:"params,omitempty"`
-	Artist string            `json:"artist,omitempty"`
-	Title  string            `json:"title,omitempty"`
-	Album  string            `json:"album,omitempty"`
-	Year   string            `json:"year,omitempty"`
-	Links  map[string]string `json:"links,omitempty"`
+	Found      bool              `json:"found"`
+	Params     sampleParams      `json:"params,omitempty"`
+	Artist     string            `json:"artist,omitempty"`
+	Title      string            `json:"title,omitempty"`
+	Album      string            `json:"album,omitempty"`
+	Year       string            `json:"year,omitempty"`
+	Genre      string            `json:"genre,omitempty"`
+	Label      string            `json:"label,omitempty"`
+	ISRC       string            `json:"isrc,omitempty"`
+	CoverArt   string            `json:"coverArt,omitempty"`
+	CoverArtHQ string            `json:"coverArtHQ,omitempty"`
+	Key        string            `json:"key,omitempty"`
+	Offset     int64             `json:"offset,omitempty"` // position within the original, in ms
+	Source     timeRangeEntry    `json:"source"`           // span of the original that was sampled
+	Track      timeRangeEntry    `json:"track"`            // span of the track containing the sample
+	Links      map[string]string `json:"links,omitempty"`
+	LinksPage  string            `json:"linksPage,omitempty"`
+	LinksGuess bool              `json:"linksGuess,omitempty"` // links were found by ISRC or search, and may be wrong
+}
+
+type timeRangeEntry struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+func newTimeRangeEntry(r timeRange) timeRangeEntry {
+	return timeRangeEntry{r.start.Milliseconds(), r.end.Milliseconds()}
+}
+
+type timelineSample struct {
+	Artist string           `json:"artist"`
+	Title  string           `json:"title"`
+	Album  string           `json:"album,omitempty"`
+	Year   string           `json:"year,omitempty"`
+	Params sampleParams     `json:"params"`
+	Ranges []timeRangeEntry `json:"ranges"`
 }
 
 type identifyJob struct {
-	ID     string      `json:"id"`
-	State  string      `json:"state"`
-	URI    string      `json:"uri"`
-	Sample sampleEntry `json:"sample"`
-	Error  string      `json:"error,omitempty"`
+	ID       string           `json:"id"`
+	State    string           `json:"state"`
+	URI      string           `json:"uri"`
+	Mode     string           `json:"mode,omitempty"`
+	BPM      float64          `json:"bpm,omitempty"`
+	Sample   sampleEntry      `json:"sample"`
+	Timeline []timelineSample `json:"timeline,omitempty"`
+	Error    string           `json:"error,omitempty"`
+
+	cancel context.CancelFunc // set while the job is running
 }
 
 type requestLogLine struct {
@@ -217,6 +298,7 @@ type logLine struct {
 }
 
 type server struct {
+	opts     searchOptions
 	jobs     map[string]*identifyJob
 	uriCache map[string]mediaURI
 	jobQueue []string
@@ -227,11 +309,20 @@ type server struct {
 func (s *server) handleJob(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	s.mu.Lock()
 	j, ok := s.jobs[ps.ByName("id")]
+	var job identifyJob
+	if ok {
+		job = *j // copied, since the job may be updated while rendering
+	}
 	s.mu.Unlock()
 	if !ok {
 		http.Error(w, "job not found", http.StatusNotFound)
 		return
 	}
+	writeJob(w, req, &job)
+}
+
+// writeJob writes j as JSON or HTML, depending on the request's Accept header.
+func writeJob(w http.ResponseWriter, req *http.Request, j *identifyJob) {
 	if req.Header.Get("Accept") == "application/json" {
 		w.Header().Set("Content-Type", "application/json")
 		enc := json.NewEncoder(w)
@@ -242,6 +333,31 @@ func (s *server) handleJob(w http.ResponseWriter, req *http.Request, ps httprout
 	}
 }
 
+func (s *server) handleCancel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[ps.ByName("id")]
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	} else if j.State == "done" {
+		http.Error(w, "job already finished", http.StatusConflict)
+		return
+	}
+	if j.cancel != nil {
+		j.cancel()
+	} else {
+		for i, id := range s.jobQueue {
+			if id == j.ID {
+				s.jobQueue = append(s.jobQueue[:i], s.jobQueue[i+1:]...)
+				break
+			}
+		}
+		delete(s.jobs, j.ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *server) handleIdentify(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	rll := &requestLogLine{
 		Start:   time.Now(),
@@ -253,7 +369,12 @@ func (s *server) handleIdentify(w http.ResponseWriter, req *http.Request, ps htt
 		json.NewEncoder(s.log).Encode(logLine{Type: "request", Request: rll})
 	}()
 
-	jobID := jobID(req.FormValue("uri"))
+	mode := req.FormValue("mode")
+	if mode != "" && mode != "timeline" {
+		http.Error(w, "unknown mode", http.StatusBadRequest)
+		return
+	}
+	jobID := jobID(req.FormValue("uri"), mode)
 	s.mu.Lock()
 	j, ok := s.jobs[jobID]
 	if !ok {
@@ -261,33 +382,35 @@ func (s *server) handleIdentify(w http.ResponseWriter, req *http.Request, ps htt
 			ID:    jobID,
 			State: "queued",
 			URI:   req.FormValue("uri"),
+			Mode:  mode,
 		}
 		s.jobs[j.ID] = j
 		s.jobQueue = append(s.jobQueue, j.ID)
 	}
+	job := *j
 	s.mu.Unlock()
-	rll.SampleKnown = j.Sample.Found
-	if req.Header.Get("Accept") == "application/json" {
-		w.Header().Set("Content-Type", "application/json")
-		enc := json.NewEncoder(w)
-		enc.SetIndent("", "  ")
-		enc.Encode(j)
-	} else {
-		templJob.Execute(w, j)
-	}
+	rll.SampleKnown = job.Sample.Found
+	writeJob(w, req, &job)
 }
 
 func (s *server) handleRoot(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	templRoot.Execute(w, nil)
 }
 
-func (s *server) doJob(j *identifyJob) {
+// doJob runs j to completion. Since handlers may read j concurrently, it is
+// only modified while holding s.mu.
+func (s *server) doJob(ctx context.Context, j *identifyJob) {
 	setState := func(state string) {
 		s.mu.Lock()
 		j.State = state
 		s.mu.Unlock()
 	}
 	defer setState("done")
+	setError := func(err error) {
+		s.mu.Lock()
+		j.Error = err.Error()
+		s.mu.Unlock()
+	}
 
 	s.mu.Lock()
 	uri, ok := s.uriCache[j.URI]
@@ -303,7 +426,7 @@ func (s *server) doJob(j *identifyJob) {
 			err = errors.New("albums are not supported in the web UI")
 		}
 		if err != nil {
-			j.Error = err.Error()
+			setError(err)
 			return
 		}
 		s.mu.Lock()
@@ -312,43 +435,95 @@ func (s *server) doJob(j *identifyJob) {
 	}
 
 	setState("fetching")
-	path, err := fetchTrack(uri, 10*(1<<20)) // 10 MiB
+	path, release, err := fetchTrack(uri, 10*(1<<20)) // 10 MiB
 	if err != nil {
-		j.Error = err.Error()
+		setError(err)
+		return
+	}
+	defer release()
+	if ctx.Err() != nil {
+		setError(ctx.Err())
+		return
+	}
+	setState("analyzing")
+	info, err := analyzeTrack(path)
+	if errors.Is(err, errTruncated) {
+		downloads.discardPath(path) // so that resubmitting the job refetches it
+	}
+	if err != nil {
+		setError(err)
 		return
 	}
+	s.mu.Lock()
+	j.BPM = math.Round(info.bpm)
+	s.mu.Unlock()
 	setState("identifying")
-	id := newTrackIdentifier(path)
-	for {
-		res, err := identifyPath(path, id.currentParams())
-		if err != nil {
-			j.Error = err.Error()
-			return
-		} else if id.handleResult(res) == nil {
-			break
+	opts := s.opts
+	opts.timeline = j.Mode == "timeline"
+	id := newTrackIdentifier(opts, info)
+	if err := id.run(ctx); err != nil {
+		setError(err)
+		return
+	}
+	var timeline []timelineSample
+	for _, e := range id.timeline {
+		ts := timelineSample{
+			Artist: e.res.Artist,
+			Title:  e.res.Title,
+			Album:  e.res.Album,
+			Year:   e.res.Year,
+			Params: sampleParams{
+				Speed:     e.params.ratio,
+				Tempo:     e.params.tempo,
+				Pitch:     e.params.pitch,
+				Effect:    e.params.effect.String(),
+				Filter:    e.params.filter.String(),
+				Timestamp: e.params.offset.Milliseconds(),
+			},
+		}
+		for _, r := range e.ranges {
+			ts.Ranges = append(ts.Ranges, newTimeRangeEntry(r))
 		}
+		timeline = append(timeline, ts)
 	}
+	s.mu.Lock()
+	j.Timeline = timeline
+	s.mu.Unlock()
 	if id.sample == nil {
-		j.Sample = sampleEntry{Found: false}
 		return
 	}
 	setState("linking")
-	links, _ := shazam.Links(id.sample.res.AppleID)
-	j.Sample = sampleEntry{
+	links, _ := findLinks(ctx, s.opts, id.sample.res)
+	sample := sampleEntry{
 		Found: true,
-		Params: struct {
-			Speed     float64 `json:"speed"`
-			Timestamp int64   `json:"timestamp"`
-		}{
+		Params: sampleParams{
 			Speed:     id.sample.params.ratio,
+			Tempo:     id.sample.params.tempo,
+			Pitch:     id.sample.params.pitch,
+			Effect:    id.sample.params.effect.String(),
+			Filter:    id.sample.params.filter.String(),
 			Timestamp: id.sample.params.offset.Milliseconds(),
 		},
-		Artist: id.sample.res.Artist,
-		Title:  id.sample.res.Title,
-		Album:  id.sample.res.Album,
-		Year:   id.sample.res.Year,
-		Links:  links,
+		Artist:     id.sample.res.Artist,
+		Title:      id.sample.res.Title,
+		Album:      id.sample.res.Album,
+		Year:       id.sample.res.Year,
+		Genre:      id.sample.res.Genre,
+		Label:      id.sample.res.Label,
+		ISRC:       id.sample.res.ISRC,
+		CoverArt:   id.sample.res.CoverArt,
+		CoverArtHQ: id.sample.res.CoverArtHQ,
+		Key:        id.sample.res.Key,
+		Offset:     id.sample.res.Offset.Milliseconds(),
+		Source:     newTimeRangeEntry(id.sample.source),
+		Track:      newTimeRangeEntry(id.sample.params.span(clipDuration)),
+		Links:      links.Platforms,
+		LinksPage:  links.PageURL,
+		LinksGuess: links.LowConfidence,
 	}
+	s.mu.Lock()
+	j.Sample = sample
+	s.mu.Unlock()
 }
 
 func (s *server) loopJobs() {
@@ -364,16 +539,31 @@ func (s *server) loopJobs() {
 		if !ok {
 			panic("unknown job in queue")
 		}
+		ctx, cancel := context.WithCancel(context.Background())
+		j.cancel = cancel
 		s.mu.Unlock()
 
 		start := time.Now()
-		s.doJob(j)
-		ll := logLine{Type: "job", Job: &identifyJobLogLine{Start: start, End: time.Now(), Job: j}}
+		s.doJob(ctx, j)
+		s.mu.Lock()
+		canceled := ctx.Err() != nil
+		j.cancel = nil
+		done := *j
+		if canceled {
+			// canceled jobs are forgotten, so that they can be resubmitted
+			delete(s.jobs, j.ID)
+		}
+		s.mu.Unlock()
+		cancel()
+		if canceled {
+			continue
+		}
+		ll := logLine{Type: "job", Job: &identifyJobLogLine{Start: start, End: time.Now(), Job: &done}}
 		json.NewEncoder(s.log).Encode(ll)
 	}
 }
 
-func newServer(dir string) (http.Handler, error) {
+func newServer(dir string, opts searchOptions, workers int) (http.Handler, error) {
 	logFile, err := os.OpenFile(path.Join(dir, "barbershop.log"), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
@@ -395,15 +585,19 @@ func newServer(dir string) (http.Handler, error) {
 	}
 
 	srv := &server{
+		opts:     opts,
 		jobs:     jobs,
 		uriCache: make(map[string]mediaURI),
 		log:      logFile,
 	}
-	go srv.loopJobs()
+	for i := 0; i < max(workers, 1); i++ {
+		go srv.loopJobs()
+	}
 	mux := httprouter.New()
 	mux.GET("/", srv.handleRoot)
 	mux.POST("/identify", srv.handleIdentify)
 	mux.GET("/job/:id", srv.handleJob)
+	mux.DELETE("/job/:id", srv.handleCancel)
 	mux.GET("/static/*path", func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		http.ServeFile(w, req, path.Join("static", ps.ByName("path")))
 	})
@@ -1,13 +1,16 @@
 package shazam
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,62 +18,294 @@ import (
 	"golang.org/x/time/rate"
 )
 
-var throttle = func() func() {
-	rl := rate.NewLimiter(rate.Every(3*time.Second), 1)
-	return func() {
-		rl.Wait(context.Background())
+// DefaultRateLimit is the default rate at which a Client sends requests.
+var DefaultRateLimit = rate.Every(3 * time.Second)
+
+// Default Client settings.
+const (
+	DefaultBaseURL       = "http://amp.shazam.com"
+	DefaultLinksBaseURL  = "https://api.song.link"
+	DefaultDeezerBaseURL = "https://api.deezer.com"
+	DefaultMaxRetries    = 5
+	DefaultBackoff       = 3 * time.Second
+)
+
+// A Geolocation is the location reported to Shazam alongside each request.
+type Geolocation struct {
+	Altitude  float64 `json:"altitude"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// A Client identifies songs using the Shazam API.
+type Client struct {
+	baseURL       string
+	linksBaseURL  string
+	deezerBaseURL string
+	httpClient    *http.Client
+	userAgent     func() string
+	geolocation   Geolocation
+	timezone      string
+	language      string
+	country       string
+	limiter       *rate.Limiter
+	maxRetries    int
+	backoff       time.Duration
+}
+
+// A ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithRateLimiter sets the limiter used to throttle requests. Clients that
+// share a limiter share its request budget. A nil limiter disables
+// throttling.
+func WithRateLimiter(l *rate.Limiter) ClientOption {
+	return func(c *Client) {
+		c.limiter = l
+	}
+}
+
+// WithBaseURL sets the base URL of the Shazam API.
+func WithBaseURL(u string) ClientOption {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+// WithLinksBaseURL sets the base URL of the song.link API.
+func WithLinksBaseURL(u string) ClientOption {
+	return func(c *Client) {
+		c.linksBaseURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+// WithDeezerBaseURL sets the base URL of the Deezer API, which is used to find
+// songs without an Apple ID.
+func WithDeezerBaseURL(u string) ClientOption {
+	return func(c *Client) {
+		c.deezerBaseURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to send requests.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithUserAgent sets the function that chooses the User-Agent of each
+// request. By default, a random Android user agent is chosen.
+func WithUserAgent(fn func() string) ClientOption {
+	return func(c *Client) {
+		c.userAgent = fn
+	}
+}
+
+// FixedUserAgent returns a user agent policy that always uses ua.
+func FixedUserAgent(ua string) func() string {
+	return func() string { return ua }
+}
+
+// RandomUserAgent is a user agent policy that picks a random Android user
+// agent for each request.
+func RandomUserAgent() string {
+	return userAgents[rand.Intn(len(userAgents))]
+}
+
+// WithGeolocation sets the location reported to Shazam.
+func WithGeolocation(g Geolocation) ClientOption {
+	return func(c *Client) {
+		c.geolocation = g
+	}
+}
+
+// WithTimezone sets the IANA timezone reported to Shazam, e.g.
+// "Europe/Berlin".
+func WithTimezone(tz string) ClientOption {
+	return func(c *Client) {
+		c.timezone = tz
+	}
+}
+
+// WithLocale sets the language and country of responses, e.g. "en" and
+// "US".
+func WithLocale(language, country string) ClientOption {
+	return func(c *Client) {
+		c.language, c.country = language, country
+	}
+}
+
+// WithRetries sets the number of times a rate-limited or failed request is
+// retried, and the initial delay between attempts, which doubles after each
+// retry.
+func WithRetries(n int, backoff time.Duration) ClientOption {
+	return func(c *Client) {
+		c.maxRetries, c.backoff = n, backoff
+	}
+}
+
+// NewClient returns a Client configured with the provided options.
+func NewClient(opts ...ClientOption) *Client {
+	c := &Client{
+		baseURL:       DefaultBaseURL,
+		linksBaseURL:  DefaultLinksBaseURL,
+		deezerBaseURL: DefaultDeezerBaseURL,
+		httpClient:    &http.Client{Timeout: 30 * time.Second},
+		userAgent:     RandomUserAgent,
+		geolocation:   Geolocation{Altitude: 300, Latitude: 45, Longitude: 2},
+		timezone:      "Europe/Berlin",
+		language:      "en",
+		country:       "US",
+		limiter:       rate.NewLimiter(DefaultRateLimit, 1),
+		maxRetries:    DefaultMaxRetries,
+		backoff:       DefaultBackoff,
 	}
-}()
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+var defaultClient = NewClient()
+
+// A StatusError is returned when an API responds with an unexpected status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("bad status: %v (%v)", e.Status, e.Body)
+}
+
+func (e *StatusError) temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// retryable reports whether err may succeed if the request is sent again:
+// transport failures and temporary statuses are retried, whereas malformed
+// requests or responses are not.
+func retryable(err error) bool {
+	var se *StatusError
+	var ue *url.Error
+	if errors.Is(err, ErrNotRecorded) {
+		return false
+	} else if errors.As(err, &se) {
+		return se.temporary()
+	}
+	return errors.As(err, &ue)
+}
+
+// do sends the request built by newReq, throttling and retrying as
+// configured, and decodes the JSON response into v.
+func (c *Client) do(ctx context.Context, throttle bool, newReq func() (*http.Request, error), v any) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		if throttle && c.limiter != nil {
+			if err := c.limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		err := c.doOnce(ctx, newReq, v)
+		if err == nil || ctx.Err() != nil || attempt >= c.maxRetries || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, newReq func() (*http.Request, error), v any) error {
+	req, err := newReq()
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return &StatusError{resp.StatusCode, resp.Status, string(body)}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
 
 // A Result contains the result of attempting to identify a song.
 type Result struct {
-	Found   bool
-	Skew    float64
-	Artist  string
-	Title   string
-	Album   string
-	Year    string
-	AppleID string
+	Found bool
+	// Skew and FrequencySkew are the relative differences in speed and pitch
+	// between the sample and the match; they are negative if the sample is
+	// slower or lower than the match.
+	Skew          float64
+	FrequencySkew float64
+	// Offset is the position of the sample within the matched song.
+	Offset     time.Duration
+	Artist     string
+	Title      string
+	Album      string
+	Year       string
+	Genre      string
+	Label      string
+	ISRC       string
+	CoverArt   string // cover art URL
+	CoverArtHQ string // high-resolution cover art URL
+	Key        string // Shazam track key, or the track ID for Index matches
+	AppleID    string
+}
+
+// Identify attempts to identify a song from its audio signature, using a
+// default Client.
+func Identify(ctx context.Context, sig Signature) (Result, error) {
+	return defaultClient.Identify(ctx, sig)
 }
 
 // Identify attempts to identify a song from its audio signature.
-func Identify(sig Signature) (Result, error) {
-	reqData := fmt.Sprintf(`{
-		"geolocation": {
-            "altitude": 300,
-            "latitude": 45,
-            "longitude": 2
-        },
-        "signature": {
-            "samplems": %v,
-            "timestamp": %v,
-            "uri": "data:audio/vnd.shazam.sig;base64,%v"
-        },
-        "timestamp": %v,
-        "timezone": "Europe/Berlin"
-	}`, sig.numSamples/sig.sampleRate*1000, time.Now().UnixMilli(), base64.StdEncoding.EncodeToString(sig.encode()), time.Now().UnixMilli())
-
-	url := fmt.Sprintf("http://amp.shazam.com/discovery/v5/en/US/android/-/tag/%v/%v", strings.ToUpper(uuid.NewString()), uuid.NewString())
-	query := "?sync=true&webv3=true&sampling=true&connected=&shazamapiversion=v3&sharehub=true&video=v3"
-
-	req, _ := http.NewRequest("POST", url+query, strings.NewReader(reqData))
-	req.Header.Set("User-Agent", userAgents[rand.Intn(len(userAgents))])
-	req.Header.Set("Content-Language", "en_US")
-	req.Header.Set("Content-Type", "application/json")
-
-again:
-	throttle()
-	resp, err := http.DefaultClient.Do(req)
+func (c *Client) Identify(ctx context.Context, sig Signature) (Result, error) {
+	type reqSignature struct {
+		SampleMS  int64  `json:"samplems"`
+		Timestamp int64  `json:"timestamp"`
+		URI       string `json:"uri"`
+	}
+	now := time.Now().UnixMilli()
+	reqData, err := json.Marshal(struct {
+		Geolocation Geolocation  `json:"geolocation"`
+		Signature   reqSignature `json:"signature"`
+		Timestamp   int64        `json:"timestamp"`
+		Timezone    string       `json:"timezone"`
+	}{
+		Geolocation: c.geolocation,
+		Signature: reqSignature{
+			SampleMS:  sig.Duration().Milliseconds(),
+			Timestamp: now,
+			URI:       sig.DataURI(),
+		},
+		Timestamp: now,
+		Timezone:  c.timezone,
+	})
 	if err != nil {
 		return Result{}, err
-	} else if resp.StatusCode == 429 {
-		time.Sleep(3 * time.Second)
-		goto again
-	} else if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return Result{}, fmt.Errorf("bad status: %v (%v)", resp.Status, string(body))
 	}
-	defer resp.Body.Close()
+
+	newReq := func() (*http.Request, error) {
+		url := fmt.Sprintf("%v/discovery/v5/%v/%v/android/-/tag/%v/%v", c.baseURL, c.language, c.country, strings.ToUpper(uuid.NewString()), uuid.NewString())
+		query := "?sync=true&webv3=true&sampling=true&connected=&shazamapiversion=v3&sharehub=true&video=v3"
+		req, err := http.NewRequest("POST", url+query, bytes.NewReader(reqData))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", c.userAgent())
+		req.Header.Set("Content-Language", c.language+"_"+c.country)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}
 	var respData struct {
 		Matches []struct {
 			ID            string
@@ -82,7 +317,15 @@ again:
 			Title    string
 			Subtitle string
 			Key      string
-			Hub      struct {
+			ISRC     string
+			Genres   struct {
+				Primary string
+			}
+			Images struct {
+				CoverArt   string
+				CoverArtHQ string
+			}
+			Hub struct {
 				Actions []struct {
 					Name string
 					ID   string
@@ -97,13 +340,13 @@ again:
 			}
 		}
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+	if err := c.do(ctx, true, newReq, &respData); err != nil {
 		return Result{}, err
 	}
 	if len(respData.Matches) == 0 {
 		return Result{Found: false}, nil
 	}
-	album, year := "", ""
+	album, year, label := "", "", ""
 	for _, section := range respData.Track.Sections {
 		for _, meta := range section.Metadata {
 			switch meta.Title {
@@ -111,6 +354,8 @@ again:
 				album = meta.Text
 			case "Released", "Sortie":
 				year = meta.Text
+			case "Label":
+				label = meta.Text
 			}
 		}
 	}
@@ -123,48 +368,163 @@ again:
 	}
 
 	return Result{
-		Found:   true,
-		Artist:  respData.Track.Subtitle,
-		Title:   respData.Track.Title,
-		Album:   album,
-		Year:    year,
-		Skew:    respData.Matches[0].TimeSkew,
-		AppleID: appleID,
+		Found:         true,
+		Artist:        respData.Track.Subtitle,
+		Title:         respData.Track.Title,
+		Album:         album,
+		Year:          year,
+		Genre:         respData.Track.Genres.Primary,
+		Label:         label,
+		ISRC:          respData.Track.ISRC,
+		CoverArt:      respData.Track.Images.CoverArt,
+		CoverArtHQ:    respData.Track.Images.CoverArtHQ,
+		Key:           respData.Track.Key,
+		Skew:          respData.Matches[0].TimeSkew,
+		FrequencySkew: respData.Matches[0].FrequencySkew,
+		Offset:        time.Duration(respData.Matches[0].Offset * float64(time.Second)),
+		AppleID:       appleID,
 	}, nil
 }
 
+// SongLinks are the streaming links for a song, as reported by song.link.
+type SongLinks struct {
+	PageURL   string // song.link page listing every platform
+	Artist    string
+	Title     string
+	Thumbnail string
+	Platforms map[string]string // platform name -> URL, e.g. "Apple Music"
+	// LowConfidence is set if the song was found by ISRC or by searching,
+	// rather than by its Apple ID, and thus may not be the right song.
+	LowConfidence bool
+}
+
+// platformNames maps song.link platform identifiers to display names.
+var platformNames = map[string]string{
+	"amazonMusic":  "Amazon Music",
+	"amazonStore":  "Amazon",
+	"anghami":      "Anghami",
+	"appleMusic":   "Apple Music",
+	"audiomack":    "Audiomack",
+	"audius":       "Audius",
+	"bandcamp":     "Bandcamp",
+	"boomplay":     "Boomplay",
+	"deezer":       "Deezer",
+	"itunes":       "iTunes",
+	"napster":      "Napster",
+	"pandora":      "Pandora",
+	"soundcloud":   "SoundCloud",
+	"spotify":      "Spotify",
+	"tidal":        "Tidal",
+	"yandex":       "Yandex",
+	"youtube":      "YouTube",
+	"youtubeMusic": "YouTube Music",
+}
+
+// PlatformName returns the display name of a song.link platform identifier.
+// Unknown identifiers are returned unchanged.
+func PlatformName(platform string) string {
+	if name, ok := platformNames[platform]; ok {
+		return name
+	}
+	return platform
+}
+
+// Links returns various streaming links for the song with the given ID, using
+// a default Client.
+func Links(ctx context.Context, appleID string) (SongLinks, error) {
+	return defaultClient.Links(ctx, appleID)
+}
+
 // Links returns various streaming links for the song with the given ID.
-func Links(appleID string) (map[string]string, error) {
-	resp, err := http.Get(fmt.Sprintf("https://api.song.link/v1-alpha.1/links?type=song&songIfSingle=true&platform=appleMusic&id=%v", appleID))
+func (c *Client) Links(ctx context.Context, appleID string) (SongLinks, error) {
+	return c.links(ctx, "appleMusic", appleID)
+}
+
+// ErrNoSong is returned when no song matches a Deezer lookup.
+var ErrNoSong = errors.New("no matching song")
+
+// LinksByISRC returns streaming links for the song with the given ISRC. The
+// song is looked up on Deezer, so the links are marked as low confidence.
+func (c *Client) LinksByISRC(ctx context.Context, isrc string) (SongLinks, error) {
+	id, err := c.deezerTrack(ctx, "/track/isrc:"+url.PathEscape(isrc))
 	if err != nil {
-		return nil, err
-	} else if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("bad status: %v (%v)", resp.Status, string(body))
+		return SongLinks{}, err
+	}
+	links, err := c.links(ctx, "deezer", id)
+	links.LowConfidence = true
+	return links, err
+}
+
+// SearchLinks returns streaming links for the best Deezer search result for
+// the given artist and title. The links are marked as low confidence.
+func (c *Client) SearchLinks(ctx context.Context, artist, title string) (SongLinks, error) {
+	q := url.Values{"q": {fmt.Sprintf("artist:%q track:%q", artist, title)}, "limit": {"1"}}
+	id, err := c.deezerTrack(ctx, "/search?"+q.Encode())
+	if err != nil {
+		return SongLinks{}, err
+	}
+	links, err := c.links(ctx, "deezer", id)
+	links.LowConfidence = true
+	return links, err
+}
+
+// deezerTrack returns the ID of the track at the given Deezer API path, which
+// may be a single track or a list of search results.
+func (c *Client) deezerTrack(ctx context.Context, path string) (string, error) {
+	newReq := func() (*http.Request, error) {
+		return http.NewRequest("GET", c.deezerBaseURL+path, nil)
+	}
+	type track struct {
+		ID int64 `json:"id"`
 	}
-	defer resp.Body.Close()
 	var respData struct {
-		LinksByPlatform struct {
-			YouTube struct {
-				URL string
-			}
-			Spotify struct {
-				URL string
-			}
-		}
+		track
+		Data []track `json:"data"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
-		return nil, err
+	if err := c.do(ctx, false, newReq, &respData); err != nil {
+		return "", err
 	}
-	links := map[string]string{
-		"YouTube": respData.LinksByPlatform.YouTube.URL,
-		"Spotify": respData.LinksByPlatform.Spotify.URL,
+	// Deezer reports missing tracks with a 200 and an error object
+	if len(respData.Data) > 0 {
+		respData.ID = respData.Data[0].ID
 	}
-	for k, v := range links {
-		if v == "" {
-			delete(links, k)
+	if respData.ID == 0 {
+		return "", ErrNoSong
+	}
+	return strconv.FormatInt(respData.ID, 10), nil
+}
+
+func (c *Client) links(ctx context.Context, platform, id string) (SongLinks, error) {
+	newReq := func() (*http.Request, error) {
+		return http.NewRequest("GET", fmt.Sprintf("%v/v1-alpha.1/links?type=song&songIfSingle=true&platform=%v&id=%v", c.linksBaseURL, platform, url.QueryEscape(id)), nil)
+	}
+	var respData struct {
+		EntityUniqueID  string `json:"entityUniqueId"`
+		PageURL         string `json:"pageUrl"`
+		LinksByPlatform map[string]struct {
+			URL string `json:"url"`
+		} `json:"linksByPlatform"`
+		EntitiesByUniqueID map[string]struct {
+			Title        string `json:"title"`
+			ArtistName   string `json:"artistName"`
+			ThumbnailURL string `json:"thumbnailUrl"`
+		} `json:"entitiesByUniqueId"`
+	}
+	if err := c.do(ctx, false, newReq, &respData); err != nil {
+		return SongLinks{}, err
+	}
+	links := SongLinks{
+		PageURL:   respData.PageURL,
+		Platforms: make(map[string]string),
+	}
+	for platform, link := range respData.LinksByPlatform {
+		if link.URL != "" {
+			links.Platforms[PlatformName(platform)] = link.URL
 		}
 	}
+	if e, ok := respData.EntitiesByUniqueID[respData.EntityUniqueID]; ok {
+		links.Artist, links.Title, links.Thumbnail = e.ArtistName, e.Title, e.ThumbnailURL
+	}
 	return links, nil
 }
 
@@ -0,0 +1,86 @@
+package shazam_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"lukechampine.com/barbershop/shazam"
+	"lukechampine.com/barbershop/shazam/shazamtest"
+)
+
+func TestFallbackLinks(t *testing.T) {
+	srv := shazamtest.NewServer()
+	defer srv.Close()
+	song := shazamtest.Song{
+		Artist:   "Junko Ohashi",
+		Title:    "Telephone Number",
+		ISRC:     "JPV198400123",
+		DeezerID: "7",
+		Links:    map[string]string{"deezer": "https://www.deezer.com/track/7"},
+	}
+	if err := srv.AddSong(song, shazam.ComputeSignature(16000, shazamtest.Synthesize(0, 16000, 10*time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	c := srv.Client()
+
+	links, err := c.LinksByISRC(context.Background(), song.ISRC)
+	if err != nil {
+		t.Fatal(err)
+	} else if !links.LowConfidence || links.Platforms["Deezer"] != song.Links["deezer"] || links.Title != song.Title {
+		t.Fatalf("unexpected links: %+v", links)
+	}
+	links, err = c.SearchLinks(context.Background(), song.Artist, song.Title)
+	if err != nil {
+		t.Fatal(err)
+	} else if !links.LowConfidence || links.Platforms["Deezer"] != song.Links["deezer"] {
+		t.Fatalf("unexpected links: %+v", links)
+	}
+
+	if _, err := c.LinksByISRC(context.Background(), "USXXX0000000"); !errors.Is(err, shazam.ErrNoSong) {
+		t.Fatalf("expected ErrNoSong, got %v", err)
+	}
+	if _, err := c.SearchLinks(context.Background(), song.Artist, "Plastic Love"); !errors.Is(err, shazam.ErrNoSong) {
+		t.Fatalf("expected ErrNoSong, got %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var requests atomic.Int32
+	var status atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(int(status.Load()))
+		w.Write([]byte("not json"))
+	}))
+	defer srv.Close()
+	c := shazam.NewClient(
+		shazam.WithBaseURL(srv.URL),
+		shazam.WithRateLimiter(rate.NewLimiter(rate.Inf, 1)),
+		shazam.WithRetries(3, time.Millisecond),
+	)
+	sig := shazam.ComputeSignature(16000, shazamtest.Synthesize(0, 16000, 3*time.Second))
+	for _, test := range []struct {
+		status int
+		want   int32
+	}{
+		{http.StatusOK, 1},                 // malformed response
+		{http.StatusBadRequest, 1},         // permanent failure
+		{http.StatusServiceUnavailable, 4}, // temporary failure
+		{http.StatusTooManyRequests, 4},    // rate limited
+	} {
+		requests.Store(0)
+		status.Store(int32(test.status))
+		if _, err := c.Identify(context.Background(), sig); err == nil {
+			t.Fatalf("%v: expected error", test.status)
+		} else if n := requests.Load(); n != test.want {
+			t.Fatalf("%v: expected %v requests, got %v", test.status, test.want, n)
+		}
+	}
+}
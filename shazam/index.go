@@ -0,0 +1,446 @@
+package shazam
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// number of peaks that each anchor peak is paired with
+	fanout = 5
+	// maximum distance (in passes) between an anchor and its paired peaks
+	maxPairDelta = 255
+	// width (in passes) of each time-offset histogram bin
+	offsetBinWidth = 4
+	// minimum number of votes required to declare a match
+	minMatchVotes = 10
+)
+
+// An IndexedTrack is a reference track stored in an Index.
+type IndexedTrack struct {
+	ID       string // unique; typically a hash of the source file
+	Path     string
+	Artist   string
+	Title    string
+	Album    string
+	Duration time.Duration
+	// size and modification time of the source file when it was indexed,
+	// used to skip unchanged files when re-indexing
+	Size    int64
+	ModTime time.Time
+}
+
+// An IndexedFile is a source file of an IndexedTrack, with the size and
+// modification time it had when it was indexed.
+type IndexedFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// A Match is the result of matching a signature against an Index.
+type Match struct {
+	Track  IndexedTrack
+	Offset time.Duration // position of the sample within the track
+	Skew   float64       // relative speed difference; negative if the sample is slower
+	Votes  int
+}
+
+type indexEntry struct {
+	track   IndexedTrack
+	aliases []IndexedFile // other source files with the same contents
+	sig     Signature
+}
+
+type posting struct {
+	slot uint32
+	pass uint32
+}
+
+type hashedPeak struct {
+	hash uint32
+	pass int
+}
+
+// hashes returns the constellation hashes of the signature. Each hash encodes
+// the frequencies of two nearby peaks and the time between them, making it
+// invariant to the absolute position of the peaks.
+func (s Signature) hashes() []hashedPeak {
+	var peaks []FrequencyPeak
+	for _, band := range s.peaksByBand {
+		peaks = append(peaks, band...)
+	}
+	sort.Slice(peaks, func(i, j int) bool {
+		if peaks[i].Pass != peaks[j].Pass {
+			return peaks[i].Pass < peaks[j].Pass
+		}
+		return peaks[i].Bin < peaks[j].Bin
+	})
+	var hs []hashedPeak
+	for i, anchor := range peaks {
+		paired := 0
+		for _, p := range peaks[i+1:] {
+			dt := p.Pass - anchor.Pass
+			if dt > maxPairDelta {
+				break
+			} else if dt == 0 {
+				continue
+			}
+			hs = append(hs, hashedPeak{
+				hash: uint32(anchor.Bin>>6)&0x3FF<<18 | uint32(p.Bin>>6)&0x3FF<<8 | uint32(dt),
+				pass: anchor.Pass,
+			})
+			if paired++; paired == fanout {
+				break
+			}
+		}
+	}
+	return hs
+}
+
+// An Index is a local database of reference tracks, supporting offline
+// identification of audio signatures.
+type Index struct {
+	sampleRate int
+	entries    []*indexEntry // nil entries have been removed
+	byID       map[string]uint32
+	postings   map[uint32][]posting
+	mu         sync.RWMutex
+}
+
+// SampleRate returns the sample rate of the signatures stored in the index.
+func (idx *Index) SampleRate() int {
+	return idx.sampleRate
+}
+
+// Tracks returns the tracks in the index, sorted by artist and title.
+func (idx *Index) Tracks() []IndexedTrack {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	tracks := make([]IndexedTrack, 0, len(idx.byID))
+	for _, e := range idx.entries {
+		if e != nil {
+			tracks = append(tracks, e.track)
+		}
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		if tracks[i].Artist != tracks[j].Artist {
+			return tracks[i].Artist < tracks[j].Artist
+		}
+		return tracks[i].Title < tracks[j].Title
+	})
+	return tracks
+}
+
+// Track returns the track with the given ID, if it exists.
+func (idx *Index) Track(id string) (IndexedTrack, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	slot, ok := idx.byID[id]
+	if !ok {
+		return IndexedTrack{}, false
+	}
+	return idx.entries[slot].track, true
+}
+
+// NumHashes returns the total number of constellation hashes in the index.
+func (idx *Index) NumHashes() (n int) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	for _, ps := range idx.postings {
+		n += len(ps)
+	}
+	return n
+}
+
+func (idx *Index) insert(e *indexEntry) {
+	slot := uint32(len(idx.entries))
+	idx.entries = append(idx.entries, e)
+	idx.byID[e.track.ID] = slot
+	for _, h := range e.sig.hashes() {
+		idx.postings[h.hash] = append(idx.postings[h.hash], posting{slot: slot, pass: uint32(h.pass)})
+	}
+}
+
+// Add adds a track to the index, replacing any existing track with the same
+// ID.
+func (idx *Index) Add(track IndexedTrack, sig Signature) error {
+	if sig.sampleRate != idx.sampleRate {
+		return fmt.Errorf("signature sample rate (%v) does not match index (%v)", sig.sampleRate, idx.sampleRate)
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(track.ID)
+	idx.insert(&indexEntry{track: track, sig: sig})
+	return nil
+}
+
+func (idx *Index) remove(id string) bool {
+	slot, ok := idx.byID[id]
+	if ok {
+		// postings are left in place, and skipped during matching; they are
+		// dropped when the index is next loaded
+		idx.entries[slot] = nil
+		delete(idx.byID, id)
+	}
+	return ok
+}
+
+// Remove removes the track with the given ID from the index. It returns false
+// if no such track exists.
+func (idx *Index) Remove(id string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.remove(id)
+}
+
+// Files returns the source files of the track with the given ID, starting with
+// its Path.
+func (idx *Index) Files(id string) []IndexedFile {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	slot, ok := idx.byID[id]
+	if !ok {
+		return nil
+	}
+	e := idx.entries[slot]
+	return append([]IndexedFile{{e.track.Path, e.track.Size, e.track.ModTime}}, e.aliases...)
+}
+
+// AddFile records f as a source file of the track with the given ID,
+// replacing any previous record of the same path. It returns false if no such
+// track exists.
+func (idx *Index) AddFile(id string, f IndexedFile) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	slot, ok := idx.byID[id]
+	if !ok {
+		return false
+	}
+	e := idx.entries[slot]
+	if e.track.Path == f.Path {
+		e.track.Size, e.track.ModTime = f.Size, f.ModTime
+		return true
+	}
+	aliases := []IndexedFile{f}
+	for _, a := range e.aliases {
+		if a.Path != f.Path {
+			aliases = append(aliases, a)
+		}
+	}
+	e.aliases = aliases
+	return true
+}
+
+// RemoveFile removes path from the source files of the track with the given
+// ID. If it was the track's only source file, the track itself is removed. It
+// returns false if the track has no such file.
+func (idx *Index) RemoveFile(id, path string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	slot, ok := idx.byID[id]
+	if !ok {
+		return false
+	}
+	e := idx.entries[slot]
+	for i, f := range e.aliases {
+		if f.Path == path {
+			e.aliases = append(e.aliases[:i:i], e.aliases[i+1:]...)
+			return true
+		}
+	}
+	if e.track.Path != path {
+		return false
+	} else if len(e.aliases) == 0 {
+		return idx.remove(id)
+	}
+	e.track.Path, e.track.Size, e.track.ModTime = e.aliases[0].Path, e.aliases[0].Size, e.aliases[0].ModTime
+	e.aliases = e.aliases[1:]
+	return true
+}
+
+// Match matches the signature against the tracks in the index, returning the
+// track with the most votes.
+func (idx *Index) Match(sig Signature) (Match, bool) {
+	if sig.sampleRate != idx.sampleRate {
+		return Match{}, false
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// vote for (track, offset) pairs
+	type bin struct {
+		slot  uint32
+		delta int
+	}
+	votes := make(map[bin]int)
+	hashes := sig.hashes()
+	for _, h := range hashes {
+		for _, p := range idx.postings[h.hash] {
+			if idx.entries[p.slot] == nil {
+				continue
+			}
+			delta := int(p.pass) - h.pass
+			votes[bin{p.slot, floorDiv(delta, offsetBinWidth)}]++
+		}
+	}
+	var best bin
+	bestVotes := 0
+	for b, n := range votes {
+		// a slow or fast sample drifts across adjacent bins, so count them too
+		n += votes[bin{b.slot, b.delta - 1}] + votes[bin{b.slot, b.delta + 1}]
+		if n > bestVotes || (n == bestVotes && (b.slot < best.slot || (b.slot == best.slot && b.delta < best.delta))) {
+			best, bestVotes = b, n
+		}
+	}
+	if bestVotes < minMatchVotes {
+		return Match{}, false
+	}
+
+	// fit a line through the pairs that voted for the best bin; the slope
+	// gives the time skew, and the intercept gives the offset
+	var n, sumQ, sumR, sumQQ, sumQR float64
+	for _, h := range hashes {
+		for _, p := range idx.postings[h.hash] {
+			if p.slot != best.slot {
+				continue
+			} else if d := floorDiv(int(p.pass)-h.pass, offsetBinWidth); d < best.delta-1 || d > best.delta+1 {
+				continue
+			}
+			q, r := float64(h.pass), float64(p.pass)
+			n++
+			sumQ += q
+			sumR += r
+			sumQQ += q * q
+			sumQR += q * r
+		}
+	}
+	slope := 1.0
+	if den := n*sumQQ - sumQ*sumQ; den != 0 {
+		slope = (n*sumQR - sumQ*sumR) / den
+	}
+	intercept := (sumR - slope*sumQ) / n
+	passDuration := time.Duration(128 * float64(time.Second) / float64(idx.sampleRate))
+	return Match{
+		Track:  idx.entries[best.slot].track,
+		Offset: time.Duration(max(intercept, 0) * float64(passDuration)),
+		Skew:   slope - 1,
+		Votes:  bestVotes,
+	}, true
+}
+
+// Identify attempts to identify a song from its audio signature, using only
+// the tracks in the index.
+func (idx *Index) Identify(ctx context.Context, sig Signature) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	} else if sig.sampleRate != idx.sampleRate {
+		return Result{}, fmt.Errorf("signature sample rate (%v) does not match index (%v)", sig.sampleRate, idx.sampleRate)
+	}
+	m, ok := idx.Match(sig)
+	if !ok {
+		return Result{Found: false}, nil
+	}
+	return Result{
+		Found:  true,
+		Skew:   m.Skew,
+		Offset: m.Offset,
+		Artist: m.Track.Artist,
+		Title:  m.Track.Title,
+		Album:  m.Track.Album,
+		Key:    m.Track.ID,
+	}, nil
+}
+
+type indexFile struct {
+	SampleRate int
+	Tracks     []IndexedTrack
+	Signatures [][]byte
+	Aliases    map[string][]IndexedFile
+}
+
+// Save writes the index to disk.
+func (idx *Index) Save(path string) error {
+	idx.mu.RLock()
+	f := indexFile{SampleRate: idx.sampleRate}
+	for _, e := range idx.entries {
+		if e != nil {
+			f.Tracks = append(f.Tracks, e.track)
+			f.Signatures = append(f.Signatures, e.sig.encode())
+			if len(e.aliases) > 0 {
+				if f.Aliases == nil {
+					f.Aliases = make(map[string][]IndexedFile)
+				}
+				f.Aliases[e.track.ID] = e.aliases
+			}
+		}
+	}
+	idx.mu.RUnlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(f); err != nil {
+		tmp.Close()
+		return err
+	} else if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	} else if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// NewIndex returns an empty index for signatures with the given sample rate.
+func NewIndex(sampleRate int) *Index {
+	return &Index{
+		sampleRate: sampleRate,
+		byID:       make(map[string]uint32),
+		postings:   make(map[uint32][]posting),
+	}
+}
+
+// LoadIndex loads an index from disk.
+func LoadIndex(path string) (*Index, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var f indexFile
+	if err := gob.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("couldn't decode index: %w", err)
+	} else if len(f.Tracks) != len(f.Signatures) {
+		return nil, errors.New("corrupt index: track/signature count mismatch")
+	}
+	idx := NewIndex(f.SampleRate)
+	for i, t := range f.Tracks {
+		var sig Signature
+		if err := sig.decode(f.Signatures[i]); err != nil {
+			return nil, fmt.Errorf("corrupt signature for track %v: %w", t.ID, err)
+		}
+		idx.insert(&indexEntry{track: t, aliases: f.Aliases[t.ID], sig: sig})
+	}
+	return idx, nil
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,65 @@
+package shazam_test
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lukechampine.com/barbershop/shazam"
+	"lukechampine.com/barbershop/shazam/shazamtest"
+)
+
+func TestIndex(t *testing.T) {
+	const sampleRate = 16000
+	idx := shazam.NewIndex(sampleRate)
+	var removedHashes int
+	for i, title := range []string{"Plastic Love", "Stay With Me", "Ride On Time"} {
+		sig := shazam.ComputeSignature(sampleRate, shazamtest.Synthesize(int64(i), sampleRate, 40*time.Second))
+		if err := idx.Add(shazam.IndexedTrack{ID: title, Title: title}, sig); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			removedHashes = idx.NumHashes()
+		}
+	}
+
+	// query a clip from the middle of the second track
+	offset := 17 * time.Second
+	track := shazamtest.Synthesize(1, sampleRate, 40*time.Second)
+	clip := track[int(offset.Seconds()*sampleRate):][:12*sampleRate]
+	m, ok := idx.Match(shazam.ComputeSignature(sampleRate, clip))
+	if !ok {
+		t.Fatal("expected match")
+	} else if m.Track.Title != "Stay With Me" {
+		t.Fatalf("wrong track: %v", m.Track.Title)
+	} else if d := m.Offset - offset; d < -100*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("wrong offset: expected %v, got %v", offset, m.Offset)
+	} else if math.Abs(m.Skew) > 0.01 {
+		t.Fatalf("unexpected skew: %v", m.Skew)
+	}
+
+	// unknown audio should not match
+	if _, ok := idx.Match(shazam.ComputeSignature(sampleRate, shazamtest.Synthesize(99, sampleRate, 12*time.Second))); ok {
+		t.Fatal("expected no match")
+	}
+
+	// round-trip through disk
+	path := filepath.Join(t.TempDir(), "index.gob")
+	if !idx.Remove("Plastic Love") {
+		t.Fatal("expected track to be removed")
+	} else if err := idx.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	idx2, err := shazam.LoadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(idx2.Tracks()) != 2 {
+		t.Fatalf("expected 2 tracks, got %v", len(idx2.Tracks()))
+	} else if idx2.NumHashes() != idx.NumHashes()-removedHashes {
+		t.Fatal("hash count mismatch after reload")
+	}
+	if m2, ok := idx2.Match(shazam.ComputeSignature(sampleRate, clip)); !ok || m2 != m {
+		t.Fatalf("match mismatch after reload: %v vs %v", m2, m)
+	}
+}
@@ -0,0 +1,72 @@
+package shazam_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"lukechampine.com/barbershop/shazam"
+	"lukechampine.com/barbershop/shazam/shazamtest"
+)
+
+func TestRecordReplay(t *testing.T) {
+	srv := shazamtest.NewServer()
+	song := shazamtest.Song{
+		Artist:   "Tatsuro Yamashita",
+		Title:    "Ride On Time",
+		CoverArt: "https://is1-ssl.mzstatic.com/image/42.jpg",
+		AppleID:  "42",
+		Links: map[string]string{
+			"spotify":    "https://open.spotify.com/track/42",
+			"appleMusic": "https://music.apple.com/us/album/42",
+		},
+	}
+	source := shazamtest.Synthesize(0, 16000, 30*time.Second)
+	if err := srv.AddSong(song, shazam.ComputeSignature(16000, source)); err != nil {
+		t.Fatal(err)
+	}
+	clip := shazam.ComputeSignature(16000, source[16000*10:16000*20])
+	other := shazam.ComputeSignature(16000, shazamtest.Synthesize(1, 16000, 10*time.Second))
+
+	dir := t.TempDir()
+	rec, err := shazam.NewRecorder(dir, srv.Server.Client().Transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := srv.Client(shazam.WithHTTPClient(&http.Client{Transport: rec}))
+	srv.RateLimit(1) // should not be recorded
+	res, err := c.Identify(context.Background(), clip)
+	if err != nil {
+		t.Fatal(err)
+	} else if !res.Found || res.Title != song.Title {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	links, err := c.Links(context.Background(), res.AppleID)
+	if err != nil {
+		t.Fatal(err)
+	} else if links.Platforms["Apple Music"] != song.Links["appleMusic"] || links.Artist != song.Artist || links.Thumbnail != song.CoverArt {
+		t.Fatalf("unexpected links: %+v", links)
+	}
+	srv.Close()
+
+	rep, err := shazam.NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = shazam.NewClient(shazam.WithBaseURL(srv.URL), shazam.WithLinksBaseURL(srv.URL), shazam.WithHTTPClient(&http.Client{Transport: rep}), shazam.WithRateLimiter(nil))
+	if res2, err := c.Identify(context.Background(), clip); err != nil {
+		t.Fatal(err)
+	} else if res2 != res {
+		t.Fatalf("replayed result differs: %+v vs %+v", res2, res)
+	}
+	if links2, err := c.Links(context.Background(), res.AppleID); err != nil {
+		t.Fatal(err)
+	} else if links2.PageURL != links.PageURL || links2.Platforms["Spotify"] != links.Platforms["Spotify"] {
+		t.Fatalf("replayed links differ: %v vs %v", links2, links)
+	}
+	if _, err := c.Identify(context.Background(), other); !errors.Is(err, shazam.ErrNotRecorded) {
+		t.Fatalf("expected ErrNotRecorded, got %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package shazamtest
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Synthesize generates d of audio at sampleRate, consisting of a sequence of
+// random chords, which produces plenty of distinct frequency peaks. The same
+// seed always produces the same audio.
+func Synthesize(seed int64, sampleRate int, d time.Duration) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]float64, int(d.Seconds()*float64(sampleRate)))
+	noteLen := sampleRate / 8
+	for i := 0; i < len(samples); i += noteLen {
+		var freqs [3]float64
+		for j := range freqs {
+			freqs[j] = 300 + rng.Float64()*4000
+		}
+		for j := i; j < min(i+noteLen, len(samples)); j++ {
+			t := float64(j) / float64(sampleRate)
+			for _, f := range freqs {
+				samples[j] += math.Sin(2*math.Pi*f*t) / 4
+			}
+		}
+	}
+	return samples
+}
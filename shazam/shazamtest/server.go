@@ -0,0 +1,364 @@
+// Package shazamtest provides a stand-in for the Shazam, song.link, and Deezer
+// APIs, for use in tests.
+package shazamtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"lukechampine.com/barbershop/shazam"
+)
+
+// A Song is an entry in a Server's song table.
+type Song struct {
+	Artist   string
+	Title    string
+	Album    string
+	Year     string
+	Genre    string
+	Label    string
+	ISRC     string
+	CoverArt string
+	AppleID  string
+	DeezerID string
+	Links    map[string]string // song.link platform -> URL, e.g. "appleMusic"
+}
+
+// A Server is a fake Shazam, song.link, and Deezer API server. It identifies submitted
+// signatures by matching them against a fingerprint index.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	index     *shazam.Index
+	songs     map[string]Song // keyed by index track ID
+	latency   time.Duration
+	limited   int // number of upcoming tag requests to answer with 429
+	failures  int // number of upcoming tag requests to answer with failCode
+	failCode  int
+	tags      int
+	linkCalls int
+}
+
+// AddSong adds a song to the table, identified by the signature of a
+// recording of it.
+func (s *Server) AddSong(song Song, sig shazam.Signature) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := song.AppleID
+	if id == "" {
+		id = song.Artist + " - " + song.Title
+	}
+	s.songs[id] = song
+	return s.index.Add(shazam.IndexedTrack{
+		ID:     id,
+		Artist: song.Artist,
+		Title:  song.Title,
+		Album:  song.Album,
+	}, sig)
+}
+
+// UseIndex answers requests from idx instead of the song table. Track IDs are
+// reported as Apple IDs.
+func (s *Server) UseIndex(idx *shazam.Index) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index = idx
+}
+
+// SetLatency delays each response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// RateLimit answers the next n tag requests with 429 Too Many Requests.
+func (s *Server) RateLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limited = n
+}
+
+// Fail answers the next n tag requests with the given status code.
+func (s *Server) Fail(n int, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures, s.failCode = n, code
+}
+
+// Requests returns the number of tag and links requests received. Deezer
+// requests count as links requests.
+func (s *Server) Requests() (tags, links int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tags, s.linkCalls
+}
+
+// Client returns a shazam.Client that talks to the server, without
+// throttling and with short retry delays.
+func (s *Server) Client(opts ...shazam.ClientOption) *shazam.Client {
+	return shazam.NewClient(append([]shazam.ClientOption{
+		shazam.WithBaseURL(s.URL),
+		shazam.WithLinksBaseURL(s.URL),
+		shazam.WithDeezerBaseURL(s.URL),
+		shazam.WithHTTPClient(s.Server.Client()),
+		shazam.WithRateLimiter(rate.NewLimiter(rate.Inf, 1)),
+		shazam.WithRetries(shazam.DefaultMaxRetries, time.Millisecond),
+	}, opts...)...)
+}
+
+type tagMatch struct {
+	ID            string  `json:"id"`
+	Offset        float64 `json:"offset"`
+	TimeSkew      float64 `json:"timeskew"`
+	FrequencySkew float64 `json:"frequencyskew"`
+}
+
+type tagAction struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+type tagMetadata struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+type tagSection struct {
+	Type     string        `json:"type"`
+	Metadata []tagMetadata `json:"metadata"`
+}
+
+type tagImages struct {
+	CoverArt   string `json:"coverart,omitempty"`
+	CoverArtHQ string `json:"coverarthq,omitempty"`
+}
+
+type tagTrack struct {
+	Title    string `json:"title"`
+	Subtitle string `json:"subtitle"`
+	Key      string `json:"key"`
+	ISRC     string `json:"isrc,omitempty"`
+	Genres   struct {
+		Primary string `json:"primary,omitempty"`
+	} `json:"genres"`
+	Images tagImages `json:"images"`
+	Hub    struct {
+		Actions []tagAction `json:"actions"`
+	} `json:"hub"`
+	Sections []tagSection `json:"sections"`
+}
+
+type tagResponse struct {
+	Matches []tagMatch `json:"matches"`
+	Track   *tagTrack  `json:"track,omitempty"`
+}
+
+func (s *Server) handleTag(w http.ResponseWriter, req *http.Request) {
+	var reqData struct {
+		Signature struct {
+			URI string `json:"uri"`
+		} `json:"signature"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&reqData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sig, err := shazam.ParseDataURI(reqData.Signature.URI)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.tags++
+	latency := s.latency
+	if s.limited > 0 {
+		s.limited--
+		s.mu.Unlock()
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+		return
+	} else if s.failures > 0 {
+		s.failures--
+		code := s.failCode
+		s.mu.Unlock()
+		http.Error(w, "simulated failure", code)
+		return
+	}
+	idx := s.index
+	s.mu.Unlock()
+
+	select {
+	case <-time.After(latency):
+	case <-req.Context().Done():
+		return
+	}
+
+	resp := tagResponse{Matches: []tagMatch{}}
+	if m, ok := idx.Match(sig); ok {
+		s.mu.Lock()
+		song, ok := s.songs[m.Track.ID]
+		s.mu.Unlock()
+		if !ok {
+			song = Song{
+				Artist:  m.Track.Artist,
+				Title:   m.Track.Title,
+				Album:   m.Track.Album,
+				AppleID: m.Track.ID,
+			}
+		}
+		resp.Matches = append(resp.Matches, tagMatch{
+			ID:       m.Track.ID,
+			Offset:   m.Offset.Seconds(),
+			TimeSkew: m.Skew,
+		})
+		track := &tagTrack{
+			Title:    song.Title,
+			Subtitle: song.Artist,
+			Key:      m.Track.ID,
+			ISRC:     song.ISRC,
+			Images:   tagImages{song.CoverArt, song.CoverArt},
+		}
+		track.Genres.Primary = song.Genre
+		if song.AppleID != "" {
+			track.Hub.Actions = []tagAction{{Name: "apple", ID: song.AppleID}}
+		}
+		section := tagSection{Type: "SONG"}
+		if song.Album != "" {
+			section.Metadata = append(section.Metadata, tagMetadata{"Album", song.Album})
+		}
+		if song.Label != "" {
+			section.Metadata = append(section.Metadata, tagMetadata{"Label", song.Label})
+		}
+		if song.Year != "" {
+			section.Metadata = append(section.Metadata, tagMetadata{"Released", song.Year})
+		}
+		track.Sections = []tagSection{section}
+		resp.Track = track
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// findSong returns the first song for which match returns true.
+func (s *Server) findSong(match func(Song) bool) (Song, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.linkCalls++
+	for _, song := range s.songs {
+		if match(song) {
+			return song, true
+		}
+	}
+	return Song{}, false
+}
+
+func (s *Server) handleLinks(w http.ResponseWriter, req *http.Request) {
+	id := req.FormValue("id")
+	song, found := s.findSong(func(song Song) bool {
+		if req.FormValue("platform") == "deezer" {
+			return song.DeezerID != "" && song.DeezerID == id
+		}
+		return song.AppleID == id
+	})
+	if !found {
+		http.Error(w, `{"statusCode":404,"code":"could_not_resolve_entity"}`, http.StatusNotFound)
+		return
+	}
+	type link struct {
+		URL string `json:"url"`
+	}
+	type entity struct {
+		Title        string `json:"title"`
+		ArtistName   string `json:"artistName"`
+		ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	}
+	entityID, pageURL := "ITUNES_SONG::"+song.AppleID, "https://song.link/i/"+song.AppleID
+	if song.AppleID == "" {
+		entityID, pageURL = "DEEZER_SONG::"+song.DeezerID, "https://song.link/d/"+song.DeezerID
+	}
+	resp := struct {
+		EntityUniqueID     string            `json:"entityUniqueId"`
+		PageURL            string            `json:"pageUrl"`
+		LinksByPlatform    map[string]link   `json:"linksByPlatform"`
+		EntitiesByUniqueID map[string]entity `json:"entitiesByUniqueId"`
+	}{
+		EntityUniqueID:  entityID,
+		PageURL:         pageURL,
+		LinksByPlatform: make(map[string]link),
+		EntitiesByUniqueID: map[string]entity{
+			entityID: {song.Title, song.Artist, song.CoverArt},
+		},
+	}
+	for platform, url := range song.Links {
+		resp.LinksByPlatform[platform] = link{url}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type deezerTrack struct {
+	ID json.Number `json:"id"`
+}
+
+func (s *Server) handleDeezerTrack(w http.ResponseWriter, req *http.Request) {
+	isrc, ok := strings.CutPrefix(req.URL.Path, "/track/isrc:")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	song, found := s.findSong(func(song Song) bool {
+		return song.DeezerID != "" && song.ISRC == isrc
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if !found {
+		// Deezer reports missing tracks with a 200
+		w.Write([]byte(`{"error":{"type":"DataException","message":"no data","code":800}}`))
+		return
+	}
+	json.NewEncoder(w).Encode(deezerTrack{json.Number(song.DeezerID)})
+}
+
+func (s *Server) handleDeezerSearch(w http.ResponseWriter, req *http.Request) {
+	q := strings.ToLower(req.FormValue("q"))
+	resp := struct {
+		Data []deezerTrack `json:"data"`
+	}{Data: []deezerTrack{}}
+	if song, found := s.findSong(func(song Song) bool {
+		return song.DeezerID != "" &&
+			strings.Contains(q, strings.ToLower(song.Artist)) &&
+			strings.Contains(q, strings.ToLower(song.Title))
+	}); found {
+		resp.Data = append(resp.Data, deezerTrack{json.Number(song.DeezerID)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// NewServer starts and returns a new Server with an empty song table. The
+// caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		index: shazam.NewIndex(16000),
+		songs: make(map[string]Song),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/discovery/v5/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || !strings.Contains(req.URL.Path, "/tag/") {
+			http.NotFound(w, req)
+			return
+		}
+		s.handleTag(w, req)
+	})
+	mux.HandleFunc("/v1-alpha.1/links", s.handleLinks)
+	mux.HandleFunc("/track/", s.handleDeezerTrack)
+	mux.HandleFunc("/search", s.handleDeezerSearch)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
@@ -2,10 +2,14 @@ package shazam
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"math"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/faiface/beep"
@@ -28,17 +32,110 @@ func convertSampleRate(x int) int {
 	}[x]
 }
 
-type frequencyPeak struct {
-	pass      int
-	magnitude int
-	bin       int
+// NumBands is the number of frequency bands in a Signature.
+const NumBands = 5
+
+// A FrequencyPeak is a time- and frequency-domain local maximum within an audio
+// sample.
+type FrequencyPeak struct {
+	Pass      int // FFT pass, in units of 128 samples
+	Magnitude int // log-scaled
+	Bin       int // FFT bin, in units of 1/64 bin
 }
 
 // A Signature is a unique fingerprint of an audio sample.
 type Signature struct {
 	sampleRate  int
 	numSamples  int
-	peaksByBand [5][]frequencyPeak
+	peaksByBand [NumBands][]FrequencyPeak
+}
+
+// SampleRate returns the sample rate of the audio the signature was computed
+// from.
+func (s Signature) SampleRate() int {
+	return s.sampleRate
+}
+
+// NumSamples returns the number of audio samples the signature was computed
+// from.
+func (s Signature) NumSamples() int {
+	return s.numSamples
+}
+
+// Duration returns the duration of the audio the signature was computed from.
+func (s Signature) Duration() time.Duration {
+	if s.sampleRate == 0 {
+		return 0
+	}
+	return time.Duration(s.numSamples) * time.Second / time.Duration(s.sampleRate)
+}
+
+// Peaks returns the peaks within the specified frequency band.
+func (s Signature) Peaks(band int) []FrequencyPeak {
+	return append([]FrequencyPeak(nil), s.peaksByBand[band]...)
+}
+
+// PeakTime returns the time offset of p within the sample.
+func (s Signature) PeakTime(p FrequencyPeak) time.Duration {
+	return time.Duration(p.Pass*128) * time.Second / time.Duration(s.sampleRate)
+}
+
+// PeakFrequency returns the frequency of p, in Hz.
+func (s Signature) PeakFrequency(p FrequencyPeak) float64 {
+	return float64(p.Bin*s.sampleRate) / (2 * 1024 * 64)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (s Signature) MarshalBinary() ([]byte, error) {
+	return s.encode(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (s *Signature) UnmarshalBinary(buf []byte) error {
+	return s.decode(buf)
+}
+
+// DataURI returns the signature encoded as a data URI, as used by the Shazam
+// API.
+func (s Signature) DataURI() string {
+	return dataURIPrefix + base64.StdEncoding.EncodeToString(s.encode())
+}
+
+const dataURIPrefix = "data:audio/vnd.shazam.sig;base64,"
+
+// ParseDataURI parses a signature encoded as a data URI.
+func ParseDataURI(uri string) (Signature, error) {
+	b64, ok := strings.CutPrefix(strings.TrimSpace(uri), dataURIPrefix)
+	if !ok {
+		return Signature{}, errors.New("not a signature data URI")
+	}
+	buf, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return Signature{}, err
+	}
+	var s Signature
+	err = s.decode(buf)
+	return s, err
+}
+
+// ReadSignatureFile reads a signature from a file. The file may contain either
+// a binary signature or a data URI.
+func ReadSignatureFile(path string) (Signature, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return Signature{}, err
+	}
+	if bytes.HasPrefix(buf, []byte(dataURIPrefix)) {
+		return ParseDataURI(string(buf))
+	}
+	var s Signature
+	err = s.decode(buf)
+	return s, err
+}
+
+// WriteSignatureFile writes a binary signature to a file.
+func WriteSignatureFile(path string, s Signature) error {
+	return os.WriteFile(path, s.encode(), 0666)
 }
 
 func (s Signature) encode() (buf []byte) {
@@ -72,15 +169,15 @@ func (s Signature) encode() (buf []byte) {
 		var peakBuf bytes.Buffer
 		pass := 0
 		for _, peak := range peaks {
-			if peak.pass-pass >= 255 {
+			if peak.Pass-pass >= 255 {
 				peakBuf.WriteByte(0xFF)
-				binary.Write(&peakBuf, binary.LittleEndian, uint32(peak.pass))
-				pass = peak.pass
+				binary.Write(&peakBuf, binary.LittleEndian, uint32(peak.Pass))
+				pass = peak.Pass
 			}
-			binary.Write(&peakBuf, binary.LittleEndian, uint8(peak.pass-pass))
-			binary.Write(&peakBuf, binary.LittleEndian, uint16(peak.magnitude))
-			binary.Write(&peakBuf, binary.LittleEndian, uint16(peak.bin))
-			pass = peak.pass
+			binary.Write(&peakBuf, binary.LittleEndian, uint8(peak.Pass-pass))
+			binary.Write(&peakBuf, binary.LittleEndian, uint16(peak.Magnitude))
+			binary.Write(&peakBuf, binary.LittleEndian, uint16(peak.Bin))
+			pass = peak.Pass
 		}
 		write(uint32(0x60030040 + band))
 		write(uint32(peakBuf.Len()))
@@ -97,6 +194,9 @@ func (s Signature) encode() (buf []byte) {
 }
 
 func (s *Signature) decode(buf []byte) error {
+	if len(buf) < 56 {
+		return errors.New("signature too short")
+	}
 	next := func() uint32 {
 		v := binary.LittleEndian.Uint32(buf)
 		buf = buf[4:]
@@ -105,52 +205,68 @@ func (s *Signature) decode(buf []byte) error {
 
 	// header
 	if next() != 0xcafe2580 {
-		return fmt.Errorf("bad magic1")
-	} else if next() != crc32.ChecksumIEEE(buf[:]) {
-		return fmt.Errorf("bad checksum")
-	} else if next() != uint32(len(buf[36:])) {
-		return fmt.Errorf("bad length")
+		return errors.New("bad magic1")
+	} else if sum := next(); sum != crc32.ChecksumIEEE(buf) {
+		return errors.New("bad checksum")
+	} else if n := next(); n != uint32(len(buf)-36) {
+		return errors.New("bad length")
 	} else if next() != 0x94119c00 {
-		return fmt.Errorf("bad magic2")
+		return errors.New("bad magic2")
 	}
 	_, _, _ = next(), next(), next()
 	s.sampleRate = convertSampleRate(int(next() >> 27))
+	if s.sampleRate == 0 {
+		return errors.New("bad sample rate")
+	}
 	_, _ = next(), next()
 	s.numSamples = int(next() - uint32(float64(s.sampleRate)*0.24))
 	if next() != 0x007c0000 {
-		return fmt.Errorf("bad magic3")
-	} else if n := next(); n != 0x40000000 {
-		fmt.Println(s.sampleRate, s.numSamples, n)
-		return fmt.Errorf("bad magic4")
-	} else if next() != uint32(len(buf))+8 {
-		return fmt.Errorf("bad length2")
+		return errors.New("bad magic3")
+	} else if next() != 0x40000000 {
+		return errors.New("bad magic4")
+	} else if n := next(); n != uint32(len(buf))+8 {
+		return errors.New("bad length2")
 	}
 
 	// peaks
+	s.peaksByBand = [NumBands][]FrequencyPeak{}
 	for len(buf) > 0 {
+		if len(buf) < 8 {
+			return errors.New("truncated band header")
+		}
 		band := int(next() - 0x60030040)
-		size := next()
+		size := int(next())
+		if band < 0 || band >= NumBands {
+			return fmt.Errorf("bad band %v", band)
+		} else if size > len(buf) {
+			return errors.New("truncated band")
+		}
 		peakBuf := bytes.NewReader(buf[:size])
 		if size%4 != 0 {
 			size += 4 - size%4
 		}
-		buf = buf[size:]
+		buf = buf[min(size, len(buf)):]
 
 		var pass uint32
 		for peakBuf.Len() > 0 {
 			offset, _ := peakBuf.ReadByte()
 			if offset == 0xFF {
-				binary.Read(peakBuf, binary.LittleEndian, &pass)
+				if err := binary.Read(peakBuf, binary.LittleEndian, &pass); err != nil {
+					return errors.New("truncated peak")
+				}
 				continue
 			}
 			pass += uint32(offset)
 			var mag, bin uint16
-			binary.Read(peakBuf, binary.LittleEndian, &mag)
-			binary.Read(peakBuf, binary.LittleEndian, &bin)
-			s.peaksByBand[band] = append(s.peaksByBand[band], frequencyPeak{
-				pass:      int(pass),
-				magnitude: int(mag),
-				bin:       int(bin),
+			if err := binary.Read(peakBuf, binary.LittleEndian, &mag); err != nil {
+				return errors.New("truncated peak")
+			} else if err := binary.Read(peakBuf, binary.LittleEndian, &bin); err != nil {
+				return errors.New("truncated peak")
+			}
+			s.peaksByBand[band] = append(s.peaksByBand[band], FrequencyPeak{
+				Pass:      int(pass),
+				Magnitude: int(mag),
+				Bin:       int(bin),
 			})
 		}
 	}
@@ -259,7 +375,7 @@ func ComputeSignature(sampleRate int, samples []float64) Signature {
 	samplesRing := newRing[float64](2048)
 	fftOutputs := newRing[[1025]float64](256)
 	spreadOutputs := newRing[[1025]float64](256)
-	var peaksByBand [5][]frequencyPeak
+	var peaksByBand [NumBands][]FrequencyPeak
 	for i := 0; i*128+128 < len(samples); i++ {
 		samplesRing = samplesRing.Append(samples[i*128:][:128]...)
 
@@ -303,16 +419,21 @@ func ComputeSignature(sampleRate int, samples []float64) Signature {
 			before := normalizePeak(fftOutput[bin-1])
 			peak := normalizePeak(fftOutput[bin])
 			after := normalizePeak(fftOutput[bin+1])
-			variation := int((32 * (after - before)) / (2*peak - after - before))
+			// quiet bins are clamped to the same floor, which would make
+			// the interpolation 0/0
+			variation := 0
+			if den := 2*peak - after - before; den != 0 {
+				variation = int((32 * (after - before)) / den)
+			}
 			peakBin := bin*64 + variation
 			band, ok := peakBand(peakBin)
 			if !ok {
 				continue
 			}
-			peaksByBand[band] = append(peaksByBand[band], frequencyPeak{
-				pass:      i - 45,
-				magnitude: int(peak),
-				bin:       peakBin,
+			peaksByBand[band] = append(peaksByBand[band], FrequencyPeak{
+				Pass:      i - 45,
+				Magnitude: int(peak),
+				Bin:       peakBin,
 			})
 		}
 	}
@@ -4,7 +4,9 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"math"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestSignature(t *testing.T) {
@@ -45,3 +47,59 @@ func TestSignature(t *testing.T) {
 		t.Fatalf("bad signature: %x", h)
 	}
 }
+
+func TestSignatureQuietPeaks(t *testing.T) {
+	// bursts quiet enough that a peak and both of its neighbors fall below
+	// the magnitude floor
+	samples := make([]float64, 16000*3)
+	for i := range samples {
+		if (i/2000)%2 == 0 {
+			samples[i] = 1e-5 * math.Sin(float64(i)*2*math.Pi/15.3)
+		}
+	}
+	sig := ComputeSignature(16000, samples)
+	var n int
+	for band := 0; band < NumBands; band++ {
+		for _, p := range sig.Peaks(band) {
+			if p.Bin < 0 || p.Bin >= 1025*64 {
+				t.Fatalf("peak in band %v has invalid bin %v", band, p.Bin)
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		t.Fatal("expected peaks")
+	}
+}
+
+func TestSignatureEncoding(t *testing.T) {
+	samples := make([]float64, 16000*3)
+	for i := range samples {
+		samples[i] = math.Sin(float64(i)*2*math.Pi/256) + math.Sin(float64(i*i)/1e6)
+	}
+	sig := ComputeSignature(16000, samples)
+
+	buf, _ := sig.MarshalBinary()
+	var sig2 Signature
+	if err := sig2.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(sig, sig2) {
+		t.Fatal("signature mismatch after binary round-trip")
+	} else if sig2.SampleRate() != 16000 || sig2.Duration() != 3*time.Second {
+		t.Fatalf("bad header: %v Hz, %v", sig2.SampleRate(), sig2.Duration())
+	}
+
+	sig3, err := ParseDataURI(sig.DataURI())
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(sig, sig3) {
+		t.Fatal("signature mismatch after data URI round-trip")
+	}
+
+	// corrupt signatures should be rejected, not panic
+	for _, b := range [][]byte{nil, buf[:40], buf[:len(buf)-3], append(append([]byte(nil), buf[:20]...), 0xFF)} {
+		if err := sig2.UnmarshalBinary(b); err == nil {
+			t.Fatal("expected error for corrupt signature")
+		}
+	}
+}
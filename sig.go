@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"lukechampine.com/barbershop/shazam"
+)
+
+var bandNames = [shazam.NumBands]string{
+	"250-520 Hz",
+	"520-1450 Hz",
+	"1450-3500 Hz",
+	"3500-5500 Hz",
+	"unused",
+}
+
+// readSignature reads a signature from a file, or parses it directly if arg is
+// a data URI.
+func readSignature(arg string) (shazam.Signature, error) {
+	if strings.HasPrefix(arg, "data:") {
+		return shazam.ParseDataURI(arg)
+	}
+	return shazam.ReadSignatureFile(arg)
+}
+
+type sigPeakJSON struct {
+	Pass      int     `json:"pass"`
+	Time      float64 `json:"time"`
+	Magnitude int     `json:"magnitude"`
+	Bin       int     `json:"bin"`
+	Frequency float64 `json:"frequency"`
+}
+
+type sigBandJSON struct {
+	Band  int           `json:"band"`
+	Range string        `json:"range"`
+	Peaks []sigPeakJSON `json:"peaks"`
+}
+
+type sigJSON struct {
+	SampleRate int           `json:"sampleRate"`
+	NumSamples int           `json:"numSamples"`
+	Duration   float64       `json:"duration"`
+	Bands      []sigBandJSON `json:"bands"`
+}
+
+func writeSignatureJSON(w io.Writer, sig shazam.Signature) error {
+	sj := sigJSON{
+		SampleRate: sig.SampleRate(),
+		NumSamples: sig.NumSamples(),
+		Duration:   sig.Duration().Seconds(),
+	}
+	for band := 0; band < shazam.NumBands; band++ {
+		peaks := sig.Peaks(band)
+		if len(peaks) == 0 {
+			continue
+		}
+		bj := sigBandJSON{Band: band, Range: bandNames[band]}
+		for _, p := range peaks {
+			bj.Peaks = append(bj.Peaks, sigPeakJSON{
+				Pass:      p.Pass,
+				Time:      sig.PeakTime(p).Seconds(),
+				Magnitude: p.Magnitude,
+				Bin:       p.Bin,
+				Frequency: sig.PeakFrequency(p),
+			})
+		}
+		sj.Bands = append(sj.Bands, bj)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sj)
+}
+
+func writeSignatureInfo(w io.Writer, sig shazam.Signature) {
+	fmt.Fprintf(w, "Sample rate: %v Hz\n", sig.SampleRate())
+	fmt.Fprintf(w, "Samples:     %v (%.3fs)\n", sig.NumSamples(), sig.Duration().Seconds())
+	fmt.Fprintln(w, "Peaks:")
+	total := 0
+	for band := 0; band < shazam.NumBands; band++ {
+		peaks := sig.Peaks(band)
+		total += len(peaks)
+		if len(peaks) == 0 {
+			fmt.Fprintf(w, "  band %v (%v): 0\n", band, bandNames[band])
+			continue
+		}
+		minMag, maxMag := peaks[0].Magnitude, peaks[0].Magnitude
+		for _, p := range peaks {
+			minMag, maxMag = min(minMag, p.Magnitude), max(maxMag, p.Magnitude)
+		}
+		var rate float64
+		if d := sig.Duration().Seconds(); d > 0 {
+			rate = float64(len(peaks)) / d
+		}
+		fmt.Fprintf(w, "  band %v (%v): %v (%.1f/s, magnitude %v-%v)\n", band, bandNames[band], len(peaks), rate, minMag, maxMag)
+	}
+	fmt.Fprintf(w, "  total: %v\n", total)
+}
+
+func writeResult(w io.Writer, res shazam.Result) {
+	if !res.Found {
+		fmt.Fprintln(w, "No match")
+		return
+	}
+	fmt.Fprintf(w, "%v - %v\n", res.Artist, res.Title)
+	if res.Album != "" {
+		fmt.Fprintf(w, "Album: %v\n", res.Album)
+	}
+	if res.Year != "" {
+		fmt.Fprintf(w, "Year:  %v\n", res.Year)
+	}
+	fmt.Fprintf(w, "Skew:  %.4f\n", res.Skew)
+}
+
+func writeSignature(sig shazam.Signature, out, format string) (err error) {
+	switch format {
+	case "base64", "json", "sig":
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	var w io.Writer = os.Stdout
+	if out != "" {
+		if format == "sig" {
+			return shazam.WriteSignatureFile(out, sig)
+		}
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		w = f
+	}
+	switch format {
+	case "base64":
+		_, err = fmt.Fprintln(w, sig.DataURI())
+	case "json":
+		err = writeSignatureJSON(w, sig)
+	case "sig":
+		buf, _ := sig.MarshalBinary()
+		_, err = w.Write(buf)
+	}
+	return err
+}